@@ -15,28 +15,44 @@
 package agent
 
 import (
+	"context"
 	"github.com/armon/go-socks5"
 	"github.com/elazarl/goproxy"
+	"github.com/op/go-logging"
 	"github.com/rsrdesarrollo/SaSSHimi/common"
 	"github.com/rsrdesarrollo/SaSSHimi/utils"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 )
 
+var logger = utils.NewLogger("agent")
+
+// Time the agent waits past the stream limits before closing a stream itself
+const expiryGrace = 5 * time.Second
+
 type agent struct {
 	common.ChannelForwarder
 	sockFilePath string
 	sockFamily   string
+	settings     *common.AgentSettings
+	settingsLock *sync.Mutex
+	resolver     *common.Resolver
+	// Socket of the daemon of a persistent agent
+	sessionPath string
 }
 
 func newAgent() agent {
 	return agent{
 		ChannelForwarder: common.ChannelForwarder{
-			OutChannel:  make(chan *common.DataMessage, 10),
+			OutQueue:    common.NewScheduler(),
 			InChannel:   make(chan *common.DataMessage, 10),
 			Reader:      os.Stdin,
 			Writer:      os.Stdout,
@@ -46,49 +62,292 @@ func newAgent() agent {
 		},
 		sockFamily:   "unix",
 		sockFilePath: "./daemon_" + utils.RandStringRunes(10),
+		settings:     &common.AgentSettings{},
+		settingsLock: &sync.Mutex{},
+	}
+}
+
+func (a *agent) getSettings() *common.AgentSettings {
+	a.settingsLock.Lock()
+	defer a.settingsLock.Unlock()
+
+	return a.settings
+}
+
+func (a *agent) getResolver() *common.Resolver {
+	a.settingsLock.Lock()
+	defer a.settingsLock.Unlock()
+
+	return a.resolver
+}
+
+func (a *agent) applySettings(settings *common.AgentSettings) {
+	a.settingsLock.Lock()
+	defer a.settingsLock.Unlock()
+
+	if settings.Policy != nil {
+		logger.Infof("Destination policy received with %d rules", len(settings.Policy.Rules))
+	}
+
+	// Data read by the agent goes down to the server
+	if settings.RateLimits != nil {
+		logger.Infof("Download limits received: %s per tunnel, %s per stream",
+			common.FormatRate(settings.RateLimits.Download), common.FormatRate(settings.RateLimits.StreamDownload))
+		a.SetReadLimits(settings.RateLimits.Download, settings.RateLimits.StreamDownload)
+	}
+
+	if settings.StreamLimits != nil {
+		logger.Infof("Stream limits received: %d streams, idle timeout %s, max lifetime %s",
+			settings.StreamLimits.MaxStreams, settings.StreamLimits.IdleTimeout, settings.StreamLimits.MaxLifetime)
+	}
+
+	if settings.Upstream != nil {
+		settings.Upstream = upstreamProxy(settings.Upstream)
+	}
+
+	if settings.DNS != nil {
+		if err := settings.DNS.Validate(); err != nil {
+			logger.Warning(err.Error() + ", using the system resolver")
+			settings.DNS = nil
+		} else {
+			logger.Infof("Resolver received: %d name servers, %d static names",
+				len(settings.DNS.Servers), len(settings.DNS.Hosts))
+		}
+	}
+	a.resolver = common.NewResolver(settings.DNS)
+
+	a.settings = settings
+}
+
+// upstreamProxy returns the upstream proxy to use, the one in the environment
+// if asked, or nil to dial directly.
+func upstreamProxy(upstream *common.UpstreamProxy) *common.UpstreamProxy {
+	if upstream.URL == common.UpstreamFromEnvironment {
+		upstream = common.UpstreamFromEnv(os.Getenv)
+		if upstream == nil {
+			logger.Warning("No upstream proxy in the environment, dialing directly")
+			return nil
+		}
+	}
+
+	if err := upstream.Validate(); err != nil {
+		logger.Warning(err.Error() + ", dialing directly")
+		return nil
+	}
+
+	logger.Infof("Dialing through the upstream proxy %s, %d destinations directly", upstream, len(upstream.NoProxy))
+	return upstream
+}
+
+// Allow implements socks5.RuleSet using the policy sent by the server.
+func (a *agent) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	return a.getSettings().Policy.Allow(ctx, req)
+}
+
+// destinationNameKey keeps in the context of a SOCKS request the name of its
+// destination, resolved before dialing.
+type destinationNameKey struct{}
+
+// Resolve implements socks5.NameResolver, leaving the names to the upstream
+// proxy if it resolves them and they are not in the static map. They are
+// still resolved here when the policy has address rules to check.
+func (a *agent) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	settings := a.getSettings()
+	resolver := a.getResolver()
+	if settings.Upstream.ResolvesNames(name) && resolver.Static(name) == nil && !settings.Policy.ChecksAddresses() {
+		return ctx, nil, nil
+	}
+
+	ctx = context.WithValue(ctx, destinationNameKey{}, name)
+
+	ip, err := resolver.LookupIP(ctx, name)
+	if err != nil {
+		return ctx, nil, err
 	}
+
+	return ctx, ip, nil
+}
+
+// dial connects to the destinations, through the upstream proxy if any. The
+// name of a resolved destination decides if it is dialed directly, and is
+// handed back to the upstream proxy if it resolves names.
+func (a *agent) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	upstream := a.getSettings().Upstream
+
+	host, port, _ := net.SplitHostPort(addr)
+	if name, ok := ctx.Value(destinationNameKey{}).(string); ok {
+		host = name
+	}
+	if upstream.ProxyFor(host) == nil {
+		upstream = nil
+	}
+
+	if !upstream.ResolvesNames(host) || a.getResolver().Static(host) != nil {
+		resolved, err := a.getResolver().ResolveAddr(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = resolved
+	} else {
+		addr = net.JoinHostPort(host, port)
+	}
+
+	return upstream.Dial(ctx, network, addr)
+}
+
+// permitsHttp applies the policy to a destination of the HTTP proxy. Names
+// are resolved first when the policy has address rules, as the SOCKS proxy
+// does.
+func (a *agent) permitsHttp(ctx context.Context, hostPort string) bool {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, portStr = hostPort, "80"
+	}
+
+	port, _ := strconv.Atoi(portStr)
+	policy := a.getSettings().Policy
+
+	var ip net.IP
+	if policy.ChecksAddresses() {
+		ip, _ = a.getResolver().LookupIP(ctx, host)
+	}
+
+	if !policy.Permits(host, ip, port) {
+		utils.WithFields(logger, utils.Fields{"destination": hostPort}).Warningf("Connection denied by policy")
+		return false
+	}
+
+	return true
 }
 
 func (a *agent) runProxyServer(done chan struct{}, useHttpProxy bool) {
 	ln, err := net.Listen(a.sockFamily, a.sockFilePath)
 
 	if err != nil {
-		utils.Logger.Fatal("Failed to bind local socket " + err.Error())
+		logger.Fatal("Failed to bind local socket " + err.Error())
 	}
 
-	utils.Logger.Noticef("Remote proxy server bind at [%s] %s", a.sockFamily, a.sockFilePath)
+	logger.Noticef("Remote proxy server bind at [%s] %s", a.sockFamily, a.sockFilePath)
 
 	if useHttpProxy {
 		proxy := goproxy.NewProxyHttpServer()
+		proxy.Logger = log.New(utils.NewLogWriter(utils.WithFields(logger, utils.Fields{"listener": "http"}), logging.INFO), "", 0)
+		proxy.ConnectDial = func(network, addr string) (net.Conn, error) {
+			return a.dial(context.Background(), network, addr)
+		}
+		proxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) {
+			return a.getSettings().Upstream.ProxyFor(req.URL.Hostname()), nil
+		}
+		// Dials the destinations not proxied, or the upstream proxy itself
+		proxy.Tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			resolved, err := a.getResolver().ResolveAddr(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, resolved)
+		}
+
+		// Refused with 403 so the server tells them from failed dials
+		proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if !a.permitsHttp(ctx.Req.Context(), host) {
+				ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, "connection not allowed by ruleset")
+				return goproxy.RejectConnect, host
+			}
+			return nil, host
+		})
+
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if !a.permitsHttp(req.Context(), req.URL.Host) {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "connection not allowed by ruleset")
+			}
+			return req, nil
+		})
 
 		done <- struct{}{}
 
 		http.Serve(ln, proxy)
 	} else {
 		conf := &socks5.Config{
-			Logger: log.New(os.Stderr, "", log.LstdFlags),
+			Logger:   log.New(utils.NewLogWriter(utils.WithFields(logger, utils.Fields{"listener": "socks5"}), logging.INFO), "", 0),
+			Rules:    a,
+			Resolver: a,
+			Dial:     a.dial,
 		}
 
 		server, err := socks5.New(conf)
 
 		if err != nil {
-			utils.Logger.Error("ERROR Creating socks socksServer: " + err.Error())
+			logger.Error("ERROR Creating socks socksServer: " + err.Error())
 		}
 
 		done <- struct{}{}
 		err = server.Serve(ln)
 
 		if err != nil {
-			utils.Logger.Error("ERROR Running socks socksServer: " + err.Error())
+			logger.Error("ERROR Running socks socksServer: " + err.Error())
+		}
+	}
+}
+
+// acceptsStream tells if a new stream fits in MaxStreams. The caller must
+// hold the clients lock.
+func (a *agent) acceptsStream() bool {
+	limits := a.getSettings().StreamLimits
+	return limits == nil || limits.MaxStreams <= 0 || len(a.Clients) < limits.MaxStreams
+}
+
+// expireClients closes, while the channel is open, the streams idle or open
+// for longer than the limits sent by the server.
+func (a *agent) expireClients() {
+	for a.ChannelOpen {
+		time.Sleep(1 * time.Second)
+
+		settings := a.getSettings()
+		if settings.StreamLimits == nil {
+			continue
+		}
+
+		// Give the server, which audits the streams, the chance to close them
+		limits := *settings.StreamLimits
+		if limits.IdleTimeout > 0 {
+			limits.IdleTimeout += expiryGrace
+		}
+		if limits.MaxLifetime > 0 {
+			limits.MaxLifetime += expiryGrace
+		}
+
+		for client, reason := range a.ExpiredClients(limits) {
+			utils.WithFields(logger, client.LogFields()).Infof("Closing stream: %s", reason)
+
+			client.Terminate()
+			client.NotifyEOF(true)
 		}
 	}
 }
 
+// readClient sends the data of a stream to the server until it finishes,
+// forgetting the stream once closed both ways.
+func (a *agent) readClient(client *common.Client) {
+	if client.ReadFromClientToChannel() {
+		a.removeClient(client)
+	}
+}
+
+func (a *agent) removeClient(client *common.Client) {
+	a.ClientsLock.Lock()
+	defer a.ClientsLock.Unlock()
+
+	if a.Clients[client.Id] == client {
+		delete(a.Clients, client.Id)
+	}
+}
+
 func (a *agent) handleInOutData() {
 	for a.ChannelOpen {
 		msg := <-a.InChannel
 
 		if msg.KeepAlive {
+			a.AckKeepAlive(msg)
 			continue
 		}
 
@@ -97,14 +356,44 @@ func (a *agent) handleInOutData() {
 			break
 		}
 
+		if msg.Settings != nil {
+			a.applySettings(msg.Settings)
+			continue
+		}
+
 		a.ClientsLock.Lock()
 		client, prs := a.Clients[msg.ClientId]
 
-		if prs == false {
+		if prs == false && (msg.CloseClient || msg.DeadClient || msg.HalfClose) {
+			// Nothing to close, the client is already gone
+			a.ClientsLock.Unlock()
+			continue
+		}
+
+		if prs == false && !a.acceptsStream() {
+			a.ClientsLock.Unlock()
+
+			logger.Warning("Stream refused, too many streams:", msg.ClientId)
+			refusal := common.NewMessage(msg.ClientId, []byte{})
+			refusal.DeadClient = true
+			a.OutQueue.Send(refusal)
+			continue
+		}
+
+		if prs == false && msg.Exec != nil {
+			client = common.NewClient(
+				msg.ClientId,
+				startExec(msg.Exec),
+				a.OutQueue,
+			)
+			client.Exec = true
+
+			utils.WithFields(logger, client.LogFields()).Debugf("New command stream")
+		} else if prs == false {
 			conn, err := net.Dial(a.sockFamily, a.sockFilePath)
 
 			if err != nil {
-				utils.Logger.Error("Connection dial error: ", err)
+				logger.Error("Connection dial error: ", err)
 				a.ClientsLock.Unlock()
 				continue
 			}
@@ -112,18 +401,28 @@ func (a *agent) handleInOutData() {
 			client = common.NewClient(
 				msg.ClientId,
 				conn,
-				a.OutChannel,
+				a.OutQueue,
 			)
 
-			utils.Logger.Debug("New connection to socks proxy from", conn.LocalAddr().String(), "for client", client.Id)
+			utils.WithFields(logger, client.LogFields()).Debugf("New connection to socks proxy from %s", conn.LocalAddr().String())
+		}
+
+		if prs == false {
+			// The server knows the destination, follow its class
+			client.Priority = msg.Priority
+			a.LimitClient(client)
 			a.Clients[msg.ClientId] = client
 
-			go client.ReadFromClientToChannel()
+			go a.readClient(client)
 		}
 		a.ClientsLock.Unlock()
 
-		if msg.CloseClient {
-			utils.Logger.Debug("Closing client sock connection for ", client.Id)
+		if msg.DeadClient {
+			utils.WithFields(logger, client.LogFields()).Debugf("Client killed by server")
+
+			// ACK for client termination
+			client.NotifyEOF(false)
+			client.Terminate()
 
 			a.ClientsLock.Lock()
 			delete(a.Clients, msg.ClientId)
@@ -132,12 +431,28 @@ func (a *agent) handleInOutData() {
 			continue
 		}
 
+		if msg.CloseClient {
+			utils.WithFields(logger, client.LogFields()).Debugf("Closing client sock connection")
+
+			a.removeClient(client)
+			continue
+		}
+
+		if msg.HalfClose {
+			utils.WithFields(logger, client.LogFields()).Debugf("Client finished writing")
+
+			if client.CloseWrite() {
+				a.removeClient(client)
+			}
+			continue
+		}
+
 		// While receiving data from dead clients ingore it until remote end confirms closure
 		if !client.IsDead() {
 			err := client.Write(msg.Data)
 
 			if err != nil {
-				utils.Logger.Error("Error writing to client connection: ", err.Error())
+				utils.WithFields(logger, client.LogFields()).Errorf("Error writing to client connection: %s", err.Error())
 
 				client.Terminate()
 				client.NotifyEOF(true)
@@ -147,35 +462,129 @@ func (a *agent) handleInOutData() {
 	}
 }
 
-func Run(useHttpProxy bool, keepBinary bool) {
+// Options of the agent, given by the server on its command line.
+type Options struct {
+	UseHttpProxy bool
+	// Leave the binary on exit, as it is cached
+	KeepBinary bool
+	// Run from memory, binding an abstract socket and with no binary to remove
+	Fileless bool
+	// File listing what the agent leaves on the host, for the cleanup command
+	Manifest string
+	// Keep the channel in a daemon for this long without server, to be
+	// attached again through the Session socket
+	Persist time.Duration
+	Session string
+	// Run as the daemon, started by the agent itself
+	Daemon bool
+	// Relay to the daemon of this session socket instead of running
+	Attach string
+}
+
+// Run starts the agent, which runs until the server closes the channel or its
+// input.
+func Run(options Options) {
+	if options.Attach != "" {
+		os.Exit(relaySession(options.Attach))
+	}
+
+	if options.Persist > 0 && options.Fileless {
+		logger.Warning("A fileless agent cannot persist, running attached")
+		options.Persist = 0
+	}
+
+	if options.Persist > 0 && !options.Daemon {
+		os.Exit(startDaemon(options))
+	}
 
 	agent := newAgent()
 
+	var token string
+	if options.Daemon {
+		token = os.Getenv(sessionTokenEnv)
+		os.Unsetenv(sessionTokenEnv)
+		agent.sessionPath = options.Session
+	}
+
+	if options.Fileless {
+		agent.sockFilePath = "@sasshimi_" + utils.RandStringRunes(10)
+	}
+
+	selfFilePath, _ := os.Executable()
+
 	onExit := func() {
-		utils.Logger.Notice("Agent is closing")
-		selfFilePath, _ := os.Executable()
+		logger.Notice("Agent is closing")
+		if options.Fileless {
+			return
+		}
+
 		os.Remove(agent.sockFilePath)
+		if agent.sessionPath != "" {
+			os.Remove(agent.sessionPath)
+		}
 
-		if !keepBinary {
+		if !options.KeepBinary {
 			os.Remove(selfFilePath)
 		}
+
+		if options.Manifest != "" {
+			os.Remove(options.Manifest)
+		}
 	}
 
 	defer onExit()
 	utils.ExitCallback(onExit)
 
+	// Once the session is gone a write to stdout would kill the agent before
+	// cleaning up, fail the write instead
+	signal.Ignore(syscall.SIGPIPE)
+	if options.Daemon {
+		signal.Ignore(syscall.SIGHUP)
+	}
+
 	proxyReady := make(chan struct{})
-	go agent.runProxyServer(proxyReady, useHttpProxy)
+	go agent.runProxyServer(proxyReady, options.UseHttpProxy)
 	<-proxyReady
 
+	if options.Manifest != "" && !options.Fileless {
+		binary := selfFilePath
+		if options.KeepBinary {
+			binary = ""
+		}
+		if err := agent.writeManifest(options.Manifest, binary); err != nil {
+			logger.Warning("Unable to write the cleanup manifest: " + err.Error())
+		}
+	}
+
 	agent.ChannelOpen = true
 
-	go agent.ReadInputData()
+	if options.Daemon {
+		agent.EnableResume()
+		go agent.handleInOutData()
+		go agent.expireClients()
+
+		agent.serveSessions(options.Session, token, options.Persist)
+		return
+	}
+
+	// Exit as soon as the input is closed, even if other goroutines are stuck,
+	// so no agent is left behind when the session dies
+	inputClosed := make(chan struct{})
+	go func() {
+		agent.ReadInputData()
+		close(inputClosed)
+	}()
 	go agent.WriteOutputData()
 
 	go agent.handleInOutData()
+	go agent.expireClients()
 
 	for agent.ChannelOpen {
-		time.Sleep(1 * time.Second)
+		select {
+		case <-inputClosed:
+			logger.Notice("Input closed")
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
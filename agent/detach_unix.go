@@ -0,0 +1,11 @@
+//go:build !windows
+
+package agent
+
+import "syscall"
+
+// detachedProcess runs the daemon in its own session, so it is not signaled
+// with the SSH session.
+func detachedProcess() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package agent
+
+import "syscall"
+
+func detachedProcess() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Exit status of a command that could not be started, as in the shells
+const execFailedStatus = 127
+
+// startExec runs the command of request for a new stream, returning the
+// connection of the stream to it.
+func startExec(request *common.ExecRequest) net.Conn {
+	local, remote := common.Pipe()
+	go runExec(remote, request)
+
+	return local
+}
+
+// runExec runs a command with its input and output in the exec frames of
+// conn, ending them with its exit status. The command is killed if conn is
+// closed before it finishes.
+func runExec(conn *common.PipeConn, request *common.ExecRequest) {
+	defer conn.CloseWrite()
+
+	writeLock := &sync.Mutex{}
+	send := func(kind byte, data []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		return common.WriteExecFrame(conn, kind, data)
+	}
+
+	process, err := startProcess(request, send)
+	if err != nil {
+		logger.Warningf("Failed to run %v: %s", request.Command, err.Error())
+		send(common.ExecStderr, []byte(err.Error()+"\n"))
+		send(common.ExecExit, common.ExitStatusData(execFailedStatus))
+		// Writes to the stream would block the channel until it closes
+		go io.Copy(io.Discard, conn)
+		return
+	}
+
+	logger.Infof("Running %s with pid %d", strings.Join(process.cmd.Args, " "), process.cmd.Process.Pid)
+
+	go process.handleFrames(conn)
+
+	status := process.wait(send)
+	logger.Infof("Process %d exited with status %d", process.cmd.Process.Pid, status)
+	send(common.ExecExit, common.ExitStatusData(status))
+}
+
+// Signals an exec stream can send to its process
+var execSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+// execProcess is the command of an exec stream, with its input and, when run
+// on a pseudo terminal, its master side.
+type execProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	pty   *os.File
+}
+
+// startProcess starts the command of request from the home of the user, as
+// an SSH session does, sending its output with send unless it runs on a
+// pseudo terminal.
+func startProcess(request *common.ExecRequest, send func(byte, []byte) error) (*execProcess, error) {
+	var cmd *exec.Cmd
+	switch {
+	case len(request.Command) > 0:
+		cmd = exec.Command(request.Command[0], request.Command[1:]...)
+	case request.Tty != nil:
+		cmd = loginShell()
+	default:
+		return nil, errors.New("no command given")
+	}
+	cmd.Dir, _ = os.UserHomeDir()
+
+	if request.Tty != nil {
+		return startOnPty(cmd, request.Tty)
+	}
+
+	cmd.Stdout = execOutput{common.ExecStdout, send}
+	cmd.Stderr = execOutput{common.ExecStderr, send}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &execProcess{cmd: cmd, stdin: stdin}, nil
+}
+
+// loginShell returns the shell of the user, started as a login shell.
+func loginShell() *exec.Cmd {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
+	cmd := exec.Command(shell)
+	// A leading dash makes it a login shell, as sshd does
+	cmd.Args[0] = "-" + filepath.Base(shell)
+
+	return cmd
+}
+
+func startOnPty(cmd *exec.Cmd, tty *common.TtyRequest) (*execProcess, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	// Only the process keeps it open, so the master reads EOF once it exits
+	defer slave.Close()
+
+	if tty.Rows > 0 && tty.Cols > 0 {
+		setPtySize(master, tty.Rows, tty.Cols)
+	}
+
+	if tty.Term != "" {
+		cmd.Env = append(os.Environ(), "TERM="+tty.Term)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	setControllingTerminal(cmd)
+
+	if err := cmd.Start(); err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	return &execProcess{cmd: cmd, stdin: master, pty: master}, nil
+}
+
+// handleFrames applies the frames received for the process until the stream
+// is closed, when the process is killed if still running.
+func (p *execProcess) handleFrames(conn io.Reader) {
+	for {
+		kind, data, err := common.ReadExecFrame(conn)
+		if err != nil {
+			// Nobody waits for the command anymore
+			p.cmd.Process.Kill()
+			return
+		}
+
+		switch kind {
+		case common.ExecStdin:
+			switch {
+			case len(data) > 0:
+				p.stdin.Write(data)
+			case p.pty != nil:
+				// The end of the input is a character on terminals
+				p.stdin.Write([]byte{4})
+			default:
+				p.stdin.Close()
+			}
+		case common.ExecResize:
+			if rows, cols := common.WindowSize(data); p.pty != nil && rows > 0 && cols > 0 {
+				setPtySize(p.pty, rows, cols)
+			}
+		case common.ExecSignal:
+			if signal, prs := execSignals[string(data)]; prs {
+				p.cmd.Process.Signal(signal)
+			}
+		}
+	}
+}
+
+// wait sends the output of the terminal, if any, until it is closed and
+// returns the exit status of the process.
+func (p *execProcess) wait(send func(byte, []byte) error) int {
+	if p.pty != nil {
+		// Fails with EIO once the processes on the terminal are gone
+		io.Copy(execOutput{common.ExecStdout, send}, p.pty)
+		p.pty.Close()
+	}
+
+	// Also waits for the output to be sent, if not on a terminal
+	p.cmd.Wait()
+
+	return exitStatus(p.cmd.ProcessState)
+}
+
+// execOutput sends what a process writes as exec frames of a kind.
+type execOutput struct {
+	kind byte
+	send func(byte, []byte) error
+}
+
+func (o execOutput) Write(data []byte) (int, error) {
+	if err := o.send(o.kind, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// exitStatus returns the exit code of a process, or 128 plus the signal that
+// killed it as the shells do.
+func exitStatus(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return state.ExitCode()
+}
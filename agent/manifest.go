@@ -0,0 +1,48 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeManifest records the process and the files of the agent, one
+// "key value" line each. The binary is left out if it is kept.
+func (a *agent) writeManifest(path string, binary string) error {
+	socket, err := filepath.Abs(a.sockFilePath)
+	if err != nil {
+		return err
+	}
+
+	manifest := &strings.Builder{}
+	fmt.Fprintf(manifest, "pid %d\n", os.Getpid())
+	fmt.Fprintf(manifest, "socket %s\n", socket)
+	if a.sessionPath != "" {
+		session, err := filepath.Abs(a.sessionPath)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(manifest, "socket %s\n", session)
+	}
+	if binary != "" {
+		fmt.Fprintf(manifest, "binary %s\n", binary)
+	}
+
+	return ioutil.WriteFile(path, []byte(manifest.String()), 0600)
+}
@@ -0,0 +1,223 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Environment variable with the session token for the daemon, so it is not
+// shown in its command line
+const sessionTokenEnv = "SASSHIMI_SESSION_TOKEN"
+
+// Time given to a new daemon to listen, and to a relay to authenticate
+const sessionTimeout = 10 * time.Second
+
+// readLine reads a line a byte at a time, so nothing that follows it is
+// consumed.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+
+	for len(line) < 256 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+
+	return "", errors.New("line too long")
+}
+
+// startDaemon runs the agent again as a daemon holding the channel, in its
+// own session, and relays the input and output to it. The token, the first
+// line of the input, is passed in the environment.
+func startDaemon(options Options) int {
+	token, err := readLine(os.Stdin)
+	if err != nil {
+		logger.Error("Unable to read the session token: " + err.Error())
+		return 1
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		logger.Error("Unable to find the agent binary: " + err.Error())
+		return 1
+	}
+
+	cmd := exec.Command(self, append(os.Args[1:], "--daemon")...)
+	cmd.Env = append(os.Environ(), sessionTokenEnv+"="+token)
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = detachedProcess()
+
+	if err := cmd.Start(); err != nil {
+		logger.Error("Unable to start the agent daemon: " + err.Error())
+		return 1
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	return relay(options.Session, token, exited)
+}
+
+// relaySession relays the input and output to the daemon of a session, the
+// token being the first line of the input.
+func relaySession(session string) int {
+	token, err := readLine(os.Stdin)
+	if err != nil {
+		logger.Error("Unable to read the session token: " + err.Error())
+		return 1
+	}
+
+	return relay(session, token, nil)
+}
+
+// relay attaches to the daemon listening at session and copies the input
+// and output to it until either side closes. If the daemon was just started,
+// exited tells when it ends before listening. It returns the exit status.
+func relay(session string, token string, exited chan error) int {
+	conn, err := dialSession(session, exited)
+	if err != nil {
+		logger.Error("No agent session at " + session + ": " + err.Error())
+		return 3
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(sessionTimeout))
+	io.WriteString(conn, token+"\n")
+	if reply, err := readLine(conn); err != nil || reply != "ok" {
+		logger.Error("Agent session refused")
+		return 1
+	}
+	conn.SetDeadline(time.Time{})
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.Close()
+	}()
+	io.Copy(os.Stdout, conn)
+
+	return 0
+}
+
+func dialSession(session string, exited chan error) (net.Conn, error) {
+	deadline := time.Now().Add(sessionTimeout)
+
+	for {
+		conn, err := net.Dial("unix", session)
+		if err == nil || exited == nil || time.Now().After(deadline) {
+			return conn, err
+		}
+
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("the agent daemon exited (%v)", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// serveSessions carries the channel through the relays attaching to the
+// session socket, a new one replacing the previous. It returns when the
+// channel is closed or no relay attaches within the grace period.
+func (a *agent) serveSessions(session string, token string, grace time.Duration) {
+	ln, err := net.Listen("unix", session)
+	if err != nil {
+		logger.Error("Failed to bind the session socket " + err.Error())
+		return
+	}
+	defer ln.Close()
+	os.Chmod(session, 0600)
+
+	logger.Noticef("Agent session at %s, kept for %s without server", session, grace)
+
+	attached := make(chan net.Conn)
+	go a.acceptRelays(ln, token, attached)
+
+	ended := make(chan net.Conn)
+	var current net.Conn
+	expiry := time.NewTimer(grace)
+	defer expiry.Stop()
+
+	for a.ChannelOpen {
+		select {
+		case conn := <-attached:
+			if current != nil {
+				logger.Notice("Server attached again, dropping its previous session")
+				current.Close()
+			} else {
+				logger.Notice("Server attached")
+			}
+			expiry.Stop()
+			current = conn
+
+			go func() {
+				a.RunTransport(conn, conn)
+				ended <- conn
+			}()
+
+		case conn := <-ended:
+			conn.Close()
+			if conn == current && a.ChannelOpen {
+				current = nil
+				expiry.Reset(grace)
+				logger.Noticef("Server detached, waiting %s for it to attach again", grace)
+			}
+
+		case <-expiry.C:
+			logger.Noticef("No server attached for %s", grace)
+			return
+
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// acceptRelays authenticates the relays connecting to the session socket.
+func (a *agent) acceptRelays(ln net.Listener, token string, attached chan net.Conn) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			conn.SetDeadline(time.Now().Add(sessionTimeout))
+			received, err := readLine(conn)
+			if err != nil || token == "" || subtle.ConstantTimeCompare([]byte(received), []byte(token)) != 1 {
+				logger.Warning("Agent session refused, wrong token")
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+
+			io.WriteString(conn, "ok\n")
+			attached <- conn
+		}()
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pseudo terminals are not supported on " + runtime.GOOS)
+}
+
+func setPtySize(master *os.File, rows uint16, cols uint16) error {
+	return nil
+}
+
+func setControllingTerminal(cmd *exec.Cmd) {
+}
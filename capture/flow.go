@@ -0,0 +1,213 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpPsh = 0x08
+	tcpAck = 0x10
+
+	// Payload of the synthesized segments, well below the IP length limit
+	maxSegmentSize = 16384
+)
+
+// Flow is a synthesized TCP connection between a client and a destination,
+// with the handshake written when it is created and a segment for every
+// chunk of data seen in either direction.
+type Flow struct {
+	file       *File
+	clientIP   net.IP
+	serverIP   net.IP
+	clientPort uint16
+	serverPort uint16
+	clientSeq  uint32
+	serverSeq  uint32
+	closed     bool
+	lock       *sync.Mutex
+}
+
+// NewFlow starts a flow from clientAddr, the address of the local client, to
+// destination, given as host:port. Clients without an IP address, as those
+// of unix sockets, are shown as connecting from localhost.
+func (f *File) NewFlow(clientAddr string, destination string) *Flow {
+	flow := &Flow{
+		file:      f,
+		clientSeq: rand.Uint32(),
+		serverSeq: rand.Uint32(),
+		lock:      &sync.Mutex{},
+	}
+
+	n := atomic.AddUint32(&f.flows, 1)
+
+	flow.clientIP, flow.clientPort = net.IPv4(127, 0, 0, 1), uint16(1024+n%64512)
+	if host, port, err := net.SplitHostPort(clientAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			flow.clientIP, flow.clientPort = ip, parsePort(port)
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(destination)
+	flow.serverIP, flow.serverPort = f.resolve(host), parsePort(port)
+
+	// Both ends must be of the same family, IPv4 ones are mapped otherwise
+	if flow.clientIP.To4() != nil && flow.serverIP.To4() != nil {
+		flow.clientIP, flow.serverIP = flow.clientIP.To4(), flow.serverIP.To4()
+	} else {
+		flow.clientIP, flow.serverIP = flow.clientIP.To16(), flow.serverIP.To16()
+	}
+
+	flow.segment(true, tcpSyn, nil)
+	flow.segment(false, tcpSyn|tcpAck, nil)
+	flow.segment(true, tcpAck, nil)
+
+	return flow
+}
+
+func parsePort(port string) uint16 {
+	n, _ := strconv.Atoi(port)
+	return uint16(n)
+}
+
+// Sent records data going from the client to the destination.
+func (fl *Flow) Sent(data []byte) {
+	fl.data(true, data)
+}
+
+// Received records data going from the destination to the client.
+func (fl *Flow) Received(data []byte) {
+	fl.data(false, data)
+}
+
+// Close writes the FIN exchange, only once.
+func (fl *Flow) Close() {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+
+	if fl.closed {
+		return
+	}
+	fl.closed = true
+
+	fl.segment(true, tcpFin|tcpAck, nil)
+	fl.segment(false, tcpFin|tcpAck, nil)
+	fl.segment(true, tcpAck, nil)
+}
+
+func (fl *Flow) data(fromClient bool, data []byte) {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+
+	if fl.closed {
+		return
+	}
+
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > maxSegmentSize {
+			chunk = chunk[:maxSegmentSize]
+		}
+		data = data[len(chunk):]
+
+		fl.segment(fromClient, tcpPsh|tcpAck, chunk)
+	}
+}
+
+// segment writes a TCP segment and advances the sequence of its sender. The
+// caller must hold the lock, except while creating the flow.
+func (fl *Flow) segment(fromClient bool, flags byte, payload []byte) {
+	srcIP, dstIP := fl.clientIP, fl.serverIP
+	srcPort, dstPort := fl.clientPort, fl.serverPort
+	seq, ack := &fl.clientSeq, fl.serverSeq
+	if !fromClient {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = &fl.serverSeq, fl.clientSeq
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	if flags&tcpAck != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], ack)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	*seq += uint32(len(payload))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		*seq++
+	}
+
+	var packet []byte
+	if len(srcIP) == net.IPv4len {
+		packet = make([]byte, 20, 20+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(packet[6:], 0x4000)
+		packet[8] = 64
+		packet[9] = 6
+		copy(packet[12:], srcIP)
+		copy(packet[16:], dstIP)
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet, 0))
+	} else {
+		packet = make([]byte, 40, 40+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6
+		packet[7] = 64
+		copy(packet[8:], srcIP)
+		copy(packet[24:], dstIP)
+	}
+
+	// Pseudo header of the TCP checksum
+	pseudo := uint32(6) + uint32(len(tcp))
+	pseudo += sum(srcIP) + sum(dstIP)
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+	fl.file.writePacket(append(packet, tcp...))
+}
+
+func sum(data []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+	return s
+}
+
+// checksum is the internet checksum of data, starting from initial.
+func checksum(data []byte, initial uint32) uint16 {
+	s := initial + sum(data)
+	for s > 0xFFFF {
+		s = (s >> 16) + (s & 0xFFFF)
+	}
+	return ^uint16(s)
+}
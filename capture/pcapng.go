@@ -0,0 +1,157 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package capture writes the payload of the streams to a pcapng file as
+// synthesized TCP flows, so they can be inspected with Wireshark.
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	blockSectionHeader   = 0x0A0D0D0A
+	blockInterface       = 0x00000001
+	blockNameResolution  = 0x00000004
+	blockEnhancedPacket  = 0x00000006
+	byteOrderMagic       = 0x1A2B3C4D
+	linkTypeRaw          = 101
+	nameResolutionIPv4   = 1
+	fakeAddressFirstByte = 198
+)
+
+// File is a pcapng capture with a single raw IP interface. It is safe to use
+// from several streams at once.
+type File struct {
+	file  *os.File
+	lock  *sync.Mutex
+	names map[string]net.IP
+	flows uint32
+}
+
+func Create(path string) (*File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		file:  file,
+		lock:  &sync.Mutex{},
+		names: make(map[string]net.IP),
+	}
+
+	// Section header, version 1.0 with unknown length
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(header[4:], 1)
+	binary.LittleEndian.PutUint16(header[6:], 0)
+	binary.LittleEndian.PutUint64(header[8:], 0xFFFFFFFFFFFFFFFF)
+
+	// Interface with raw IPv4/IPv6 packets and no snap length
+	iface := make([]byte, 8)
+	binary.LittleEndian.PutUint16(iface[0:], linkTypeRaw)
+
+	if err := f.writeBlock(blockSectionHeader, header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := f.writeBlock(blockInterface, iface); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.file.Close()
+}
+
+// writeBlock writes a block with its body padded to 32 bits. The caller
+// must hold the lock, except while creating the file.
+func (f *File) writeBlock(blockType uint32, body []byte) error {
+	padded := (len(body) + 3) &^ 3
+	length := 12 + padded
+
+	block := make([]byte, length)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], uint32(length))
+	copy(block[8:], body)
+	binary.LittleEndian.PutUint32(block[length-4:], uint32(length))
+
+	_, err := f.file.Write(block)
+	return err
+}
+
+func (f *File) writePacket(packet []byte) {
+	micros := uint64(time.Now().UnixNano() / 1000)
+
+	body := make([]byte, 20+len(packet))
+	binary.LittleEndian.PutUint32(body[0:], 0)
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	copy(body[20:], packet)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.writeBlock(blockEnhancedPacket, body)
+}
+
+// resolve returns the address of a destination host. Names are given a fake
+// address from the benchmarking range 198.18.0.0/15, recorded in a name
+// resolution block so Wireshark shows the name instead.
+func (f *File) resolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if ip, prs := f.names[host]; prs {
+		return ip
+	}
+
+	n := len(f.names) + 1
+	ip := net.IPv4(fakeAddressFirstByte, byte(18+(n>>16)&1), byte(n>>8), byte(n)).To4()
+	f.names[host] = ip
+
+	record := make([]byte, 4, 4+len(ip)+len(host)+1)
+	binary.LittleEndian.PutUint16(record[0:], nameResolutionIPv4)
+	binary.LittleEndian.PutUint16(record[2:], uint16(len(ip)+len(host)+1))
+	record = append(record, ip...)
+	record = append(record, host...)
+	record = append(record, 0)
+	for len(record)%4 != 0 {
+		record = append(record, 0)
+	}
+
+	// Empty end of records
+	record = append(record, 0, 0, 0, 0)
+
+	f.writeBlock(blockNameResolution, record)
+
+	return ip
+}
@@ -17,23 +17,46 @@ package cli
 import (
 	"github.com/rsrdesarrollo/SaSSHimi/agent"
 	"github.com/spf13/cobra"
+	"time"
 )
 
 var useHttpProxy bool
 var keepBinary bool
+var fileless bool
+var manifest string
+var persist time.Duration
+var session string
+var daemon bool
+var attach string
 
 // agentCmd represents the agent command
 var agentCmd = &cobra.Command{
 	Use:   "agent",
 	Short: "Run as remote agent process",
 	Run: func(cmd *cobra.Command, args []string) {
-		agent.Run(useHttpProxy, keepBinary)
+		agent.Run(agent.Options{
+			UseHttpProxy: useHttpProxy,
+			KeepBinary:   keepBinary,
+			Fileless:     fileless,
+			Manifest:     manifest,
+			Persist:      persist,
+			Session:      session,
+			Daemon:       daemon,
+			Attach:       attach,
+		})
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(agentCmd)
 
-	agentCmd.Flags().BoolVar(&useHttpProxy, "use-http", false, "Use HTTP proxy instead of HTTP")
+	agentCmd.Flags().BoolVar(&useHttpProxy, "use-http", false, "Use HTTP proxy instead of SOCKS5")
 	agentCmd.Flags().BoolVarP(&keepBinary, "keep-binary", "k",  false, "Do not remove binary when closing")
+	agentCmd.Flags().BoolVar(&fileless, "fileless", false, "Run from memory, binding an abstract socket")
+	agentCmd.Flags().StringVar(&manifest, "manifest", "", "Record the agent process and files in this file for cleanup")
+	agentCmd.Flags().DurationVar(&persist, "persist", 0, "Keep the streams in a daemon for this long without server, reading the session token from the input")
+	agentCmd.Flags().StringVar(&session, "session", "", "Socket of the persistent agent session")
+	agentCmd.Flags().BoolVar(&daemon, "daemon", false, "Run as the daemon of a persistent agent")
+	agentCmd.Flags().MarkHidden("daemon")
+	agentCmd.Flags().StringVar(&attach, "attach", "", "Relay to the persistent agent session at this socket, reading the session token from the input")
 }
@@ -0,0 +1,62 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/spf13/cobra"
+)
+
+var cleanupAll bool
+var cleanupCache bool
+
+// cleanupCmd represents the cleanup command
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup <user@host:port|host_id>",
+	Short: "Remove the agents and files left on a remote host",
+	Long: `Kill the orphaned agents of the user on the remote host and remove the
+binaries, sockets and manifests of the agents no longer running.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		subv := hostConfig(args[0])
+		subv.SetDefault("PrivateKey", idFile)
+		subv.SetDefault("Upload.Directories", remoteDirectories)
+
+		actions, err := server.Cleanup(subv, cleanupAll, cleanupCache)
+		if err != nil {
+			return err
+		}
+
+		if len(actions) == 0 {
+			fmt.Println("Nothing to clean")
+		}
+		for _, action := range actions {
+			fmt.Println(action)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cleanupCmd)
+
+	cleanupCmd.Flags().StringVarP(&idFile, "identity_file", "i", "", "Path to private key")
+	cleanupCmd.Flags().StringSliceVar(&remoteDirectories, "remote-dirs", nil, "Remote directories to clean (default $HOME,/tmp,/dev/shm,$XDG_RUNTIME_DIR)")
+	cleanupCmd.Flags().BoolVar(&cleanupAll, "all", false, "Also kill the agents still attached to a session")
+	cleanupCmd.Flags().BoolVar(&cleanupCache, "cache", false, "Also remove the cached agents")
+}
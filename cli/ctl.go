@@ -0,0 +1,424 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var ctlSocket string
+
+// ctlCmd represents the ctl command
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Inspect and control a running server through its control socket",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// Errors come from the server, not from a wrong usage
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+	},
+}
+
+var ctlClientsCmd = &cobra.Command{
+	Use:   "clients",
+	Short: "List the active clients",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var clients []server.ClientInfo
+		if err := ctlRequest(http.MethodGet, "/clients", nil, &clients); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTUNNEL\tDESTINATION\tSTATE\tPRIORITY\tAGE\tSENT\tRECEIVED")
+		for _, c := range clients {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", c.Id, c.Tunnel, c.Destination, c.State, c.Priority, c.Age.Round(time.Second), c.BytesSent, c.BytesReceived)
+		}
+		return w.Flush()
+	},
+}
+
+var ctlKillCmd = &cobra.Command{
+	Use:   "kill <client_id>",
+	Short: "Close a client connection",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ctlRequest(http.MethodDelete, "/clients/"+url.PathEscape(args[0]), nil, nil)
+	},
+}
+
+var ctlTunnelsCmd = &cobra.Command{
+	Use:   "tunnels",
+	Short: "List the tunnels and their state",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var tunnels []server.TunnelInfo
+		if err := ctlRequest(http.MethodGet, "/tunnels", nil, &tunnels); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tPOOL\tREMOTE HOST\tALIVE\tSTREAMS\tRTT")
+		for _, t := range tunnels {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%d\t%s\n", t.Name, t.Pool, t.RemoteHost, t.Alive, t.Streams, t.RTT.Round(time.Microsecond))
+		}
+		return w.Flush()
+	},
+}
+
+var ctlReconnectCmd = &cobra.Command{
+	Use:   "reconnect [remote_host]",
+	Short: "Reconnect the tunnels to a remote host, or all of them",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "/tunnels/reconnect"
+		if len(args) == 1 {
+			path += "?host=" + url.QueryEscape(args[0])
+		}
+
+		var reconnected int
+		if err := ctlRequest(http.MethodPost, path, nil, &reconnected); err != nil {
+			return err
+		}
+
+		fmt.Printf("%d tunnels reconnected\n", reconnected)
+		return nil
+	},
+}
+
+var ctlForwardCmd = &cobra.Command{
+	Use:   "forward",
+	Short: "Manage the local listeners",
+}
+
+var ctlForwardListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the local listeners",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var forwards []server.ForwardInfo
+		if err := ctlRequest(http.MethodGet, "/forwards", nil, &forwards); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "BIND\tPROTOCOL\tTARGET")
+		for _, f := range forwards {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", f.Bind, f.Protocol, f.Target)
+		}
+		return w.Flush()
+	},
+}
+
+var ctlForwardAddCmd = &cobra.Command{
+	Use:   "add <bind> <host:port>",
+	Short: "Forward a new local address to a remote destination",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ctlRequest(http.MethodPost, "/forwards", server.ForwardInfo{Bind: args[0], Target: args[1]}, nil)
+	},
+}
+
+var ctlForwardRemoveCmd = &cobra.Command{
+	Use:   "remove <bind>",
+	Short: "Stop forwarding a local address",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ctlRequest(http.MethodDelete, "/forwards?bind="+url.QueryEscape(args[0]), nil, nil)
+	},
+}
+
+var ctlLogLevelCmd = &cobra.Command{
+	Use:   "loglevel <level> [module]",
+	Short: "Change the log level (critical, error, warning, notice, info, debug) of a module, or of all of them",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		query := url.Values{"level": {args[0]}}
+		if len(args) == 2 {
+			query.Set("module", args[1])
+		}
+		return ctlRequest(http.MethodPut, "/loglevel?"+query.Encode(), nil, nil)
+	},
+}
+
+var ctlRateLimitCmd = &cobra.Command{
+	Use:   "ratelimit [remote_host]",
+	Short: "Show or change the rate limits (bytes per second with K, M or G suffix, 0 for unlimited) of the tunnels",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		query := url.Values{}
+		for _, name := range []string{"upload", "download", "stream-upload", "stream-download"} {
+			if cmd.Flags().Changed(name) {
+				value, _ := cmd.Flags().GetString(name)
+				query.Set(name, value)
+			}
+		}
+
+		if len(query) > 0 {
+			if len(args) == 1 {
+				query.Set("host", args[0])
+			}
+
+			var changed int
+			if err := ctlRequest(http.MethodPut, "/ratelimits?"+query.Encode(), nil, &changed); err != nil {
+				return err
+			}
+			fmt.Printf("%d tunnels changed\n", changed)
+			return nil
+		}
+
+		var limits []server.RateLimitInfo
+		if err := ctlRequest(http.MethodGet, "/ratelimits", nil, &limits); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TUNNEL\tUPLOAD\tDOWNLOAD\tSTREAM UPLOAD\tSTREAM DOWNLOAD")
+		for _, l := range limits {
+			if len(args) == 1 && !strings.HasPrefix(l.Tunnel, args[0]) {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", l.Tunnel, common.FormatRate(l.Upload), common.FormatRate(l.Download),
+				common.FormatRate(l.StreamUpload), common.FormatRate(l.StreamDownload))
+		}
+		return w.Flush()
+	},
+}
+
+var ctlExecCmd = &cobra.Command{
+	Use:   "exec [--host host_id] [--] <command> [args...]",
+	Short: "Run a command on the remote host through the agent, with its exit status",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "/exec"
+		if host, _ := cmd.Flags().GetString("host"); host != "" {
+			path += "?host=" + url.QueryEscape(host)
+		}
+
+		conn, err := ctlUpgrade(path, common.ExecRequest{Command: args}, server.ExecProtocol)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		status, err := relayExec(conn, false)
+		if err != nil {
+			return err
+		}
+
+		os.Exit(status)
+		return nil
+	},
+}
+
+// Signals relayed to the command of an exec stream
+var execSignalNames = map[os.Signal]string{
+	os.Interrupt:    "INT",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGQUIT: "QUIT",
+}
+
+// relayExec relays the standard streams and the signals of this process to
+// the command of an exec stream, and the size of the terminal if it runs on
+// one, until the command exits. It returns its exit status.
+func relayExec(conn io.ReadWriter, tty bool) (int, error) {
+	writeLock := &sync.Mutex{}
+	send := func(kind byte, data []byte) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		common.WriteExecFrame(conn, kind, data)
+	}
+
+	go func() {
+		data := make([]byte, 32*1024)
+		for {
+			n, err := os.Stdin.Read(data)
+			if n > 0 {
+				send(common.ExecStdin, data[:n])
+			}
+			if err != nil {
+				// Also sent on errors, so the command ends
+				send(common.ExecStdin, nil)
+				return
+			}
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	for sig := range execSignalNames {
+		signal.Notify(signals, sig)
+	}
+	resizes := make(chan os.Signal, 1)
+	if tty {
+		server.NotifyWindowResize(resizes)
+	}
+
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				send(common.ExecSignal, []byte(execSignalNames[sig]))
+			case <-resizes:
+				if rows, cols, ok := terminalSize(); ok {
+					send(common.ExecResize, common.WindowSizeData(rows, cols))
+				}
+			}
+		}
+	}()
+
+	for {
+		kind, data, err := common.ReadExecFrame(conn)
+		if err != nil {
+			return 0, errors.New("Command stream closed without exit status")
+		}
+
+		switch kind {
+		case common.ExecStdout:
+			os.Stdout.Write(data)
+		case common.ExecStderr:
+			os.Stderr.Write(data)
+		case common.ExecExit:
+			return common.ExitStatus(data), nil
+		}
+	}
+}
+
+// ctlRequest sends a request to the control socket, encoding body and
+// decoding the response into result when they are not nil.
+func ctlRequest(method string, path string, body interface{}, result interface{}) error {
+	client, err := ctlClient()
+	if err != nil {
+		return err
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://control"+path, reqBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.New("Unable to reach control socket: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+
+	return nil
+}
+
+// ctlUpgrade posts body to the control socket, switching the connection to
+// protocol, and returns the connection.
+func ctlUpgrade(path string, body interface{}, protocol string) (io.ReadWriteCloser, error) {
+	client, err := ctlClient()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://control"+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.New("Unable to reach control socket: " + err.Error())
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(strings.TrimSpace(string(msg)))
+	}
+
+	return resp.Body.(io.ReadWriteCloser), nil
+}
+
+func ctlClient() (*http.Client, error) {
+	socketPath, err := homedir.Expand(ctlSocket)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}, nil
+}
+
+func init() {
+	rootCmd.AddCommand(ctlCmd)
+
+	ctlCmd.PersistentFlags().StringVar(&ctlSocket, "control", server.DefaultControlSocket, "Path to the control socket of the server")
+
+	ctlCmd.AddCommand(ctlClientsCmd, ctlKillCmd, ctlTunnelsCmd, ctlReconnectCmd, ctlForwardCmd, ctlLogLevelCmd, ctlRateLimitCmd, ctlExecCmd)
+	ctlForwardCmd.AddCommand(ctlForwardListCmd, ctlForwardAddCmd, ctlForwardRemoveCmd)
+
+	// Flags after the command are its own
+	ctlExecCmd.Flags().SetInterspersed(false)
+	ctlExecCmd.Flags().String("host", "", "Host section of the tunnels to run the command through, the default ones if empty")
+
+	ctlRateLimitCmd.Flags().String("upload", "", "Limit of the data sent through each tunnel")
+	ctlRateLimitCmd.Flags().String("download", "", "Limit of the data received through each tunnel")
+	ctlRateLimitCmd.Flags().String("stream-upload", "", "Limit of the data sent by each stream")
+	ctlRateLimitCmd.Flags().String("stream-download", "", "Limit of the data received by each stream")
+}
@@ -16,7 +16,7 @@ package cli
 
 import (
 	"fmt"
-	"github.com/op/go-logging"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
 	"os"
 
 	"github.com/mitchellh/go-homedir"
@@ -26,7 +26,7 @@ import (
 
 var cfgFile string
 var verboseLevel int
-var bindAddress string
+var bindAddresses []string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -53,6 +53,17 @@ func init() {
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.SaSSHimi.yaml)")
 	rootCmd.PersistentFlags().CountVarP(&verboseLevel, "verbose", "v", "verbose level")
+	rootCmd.PersistentFlags().String("log-format", utils.LogFormatText, "Log format (text, json)")
+	rootCmd.PersistentFlags().String("log-file", "", "Also write the log to this file")
+	rootCmd.PersistentFlags().String("log-level", "", "Log levels as level or module=level, comma separated (modules: server, agent, common)")
+	rootCmd.PersistentFlags().Int64("log-max-size", 10, "Rotate the log file when it grows over this size in MB")
+	rootCmd.PersistentFlags().Int("log-max-backups", 3, "Number of rotated log files to keep")
+
+	viper.BindPFlag("LogFormat", rootCmd.PersistentFlags().Lookup("log-format"))
+	viper.BindPFlag("LogFile", rootCmd.PersistentFlags().Lookup("log-file"))
+	viper.BindPFlag("LogLevel", rootCmd.PersistentFlags().Lookup("log-level"))
+	viper.BindPFlag("LogMaxSize", rootCmd.PersistentFlags().Lookup("log-max-size"))
+	viper.BindPFlag("LogMaxBackups", rootCmd.PersistentFlags().Lookup("log-max-backups"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -76,11 +87,22 @@ func initConfig() {
 	viper.AutomaticEnv() // read in environment variables that match
 	viper.ReadInConfig()
 
-	if verboseLevel == 0 {
-		logging.SetLevel(logging.NOTICE, "SaSSHimi")
-	} else if verboseLevel == 1 {
-		logging.SetLevel(logging.INFO, "SaSSHimi")
-	} else {
-		logging.SetLevel(logging.DEBUG, "SaSSHimi")
+	logFile, err := homedir.Expand(viper.GetString("LogFile"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = utils.SetupLogging(utils.LogConfig{
+		Format:     viper.GetString("LogFormat"),
+		File:       logFile,
+		MaxSize:    viper.GetInt64("LogMaxSize") * 1024 * 1024,
+		MaxBackups: viper.GetInt("LogMaxBackups"),
+		Verbose:    verboseLevel,
+		Levels:     viper.GetString("LogLevel"),
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
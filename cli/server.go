@@ -24,6 +24,34 @@ import (
 
 var idFile string
 var remoteExecutable string
+var policyFile string
+var poolSize int
+var balance string
+var controlSocket string
+var metricsAddress string
+var dashboard bool
+var auditLog string
+var captureFile string
+var uploadLimit string
+var downloadLimit string
+var streamUploadLimit string
+var streamDownloadLimit string
+var maxStreams int
+var maxStreamsPerClient int
+var idleTimeout string
+var maxLifetime string
+var uploadMethods []string
+var remoteDirectories []string
+var agentDir string
+var persistAgent string
+var upstreamProxy string
+var noProxy []string
+var dnsServers []string
+var resolveNames string
+var agentCache bool
+var filelessAgent bool
+var compressAgent bool
+var agentHttp bool
 
 // serverCmd represents the server command
 var serverCmd = &cobra.Command{
@@ -32,35 +60,107 @@ var serverCmd = &cobra.Command{
 	Long:  ``,
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		tokens := strings.Split(args[0], "@")
+		subv := hostConfig(args[0])
 
-		user, remoteHost := strings.Join(tokens[:len(tokens)-1], "@"), tokens[len(tokens)-1]
-
-		subv := viper.Sub(remoteHost)
+		subv.SetDefault("PrivateKey", idFile)
+		subv.SetDefault("RemoteExecutable", remoteExecutable)
+		subv.SetDefault("Policy", policyFile)
+		subv.SetDefault("Pool.Size", poolSize)
+		subv.SetDefault("Pool.Balance", balance)
+		subv.SetDefault("ControlSocket", controlSocket)
+		subv.SetDefault("MetricsListen", metricsAddress)
+		subv.SetDefault("Dashboard", dashboard)
+		subv.SetDefault("AuditLog", auditLog)
+		subv.SetDefault("Capture", captureFile)
+		subv.SetDefault("RateLimit.Upload", uploadLimit)
+		subv.SetDefault("RateLimit.Download", downloadLimit)
+		subv.SetDefault("RateLimit.StreamUpload", streamUploadLimit)
+		subv.SetDefault("RateLimit.StreamDownload", streamDownloadLimit)
+		subv.SetDefault("Limits.MaxStreams", maxStreams)
+		subv.SetDefault("Limits.MaxStreamsPerClient", maxStreamsPerClient)
+		subv.SetDefault("Limits.IdleTimeout", idleTimeout)
+		subv.SetDefault("Limits.MaxLifetime", maxLifetime)
+		subv.SetDefault("Upload.Methods", uploadMethods)
+		subv.SetDefault("Upload.Directories", remoteDirectories)
+		subv.SetDefault("AgentDir", agentDir)
+		subv.SetDefault("Upload.Cache", agentCache)
+		subv.SetDefault("Upload.Fileless", filelessAgent)
+		subv.SetDefault("Upload.Compress", compressAgent)
+		subv.SetDefault("Persist", persistAgent)
+		subv.SetDefault("Upstream.Proxy", upstreamProxy)
+		subv.SetDefault("Upstream.NoProxy", noProxy)
+		subv.SetDefault("DNS.Servers", dnsServers)
+		subv.SetDefault("DNS.Resolve", resolveNames)
+		subv.SetDefault("AgentHttp", agentHttp)
 
-		if subv == nil {
-			subv = viper.GetViper()
+		// Listeners in the config file replace the default bind address
+		binds := bindAddresses
+		if !cmd.Flags().Changed("bind") && subv.IsSet("Listeners") {
+			binds = nil
 		}
 
-		utils.Logger.Debug("Parsed User:", user)
-		utils.Logger.Debug("Parsed Remote Host:", remoteHost)
+		server.Run(subv, binds, verboseLevel)
+	},
+}
 
-		if user != "" {
-			subv.Set("User", user)
-		}
+// hostConfig returns the config of a user@host:port or host_id argument, the
+// section of host_id in the config file if there is one.
+func hostConfig(arg string) *viper.Viper {
+	tokens := strings.Split(arg, "@")
 
-		subv.SetDefault("RemoteHost", remoteHost)
-		subv.SetDefault("PrivateKey", idFile)
-		subv.SetDefault("RemoteExecutable", remoteExecutable)
+	user, remoteHost := strings.Join(tokens[:len(tokens)-1], "@"), tokens[len(tokens)-1]
 
-		server.Run(subv, bindAddress, verboseLevel)
-	},
+	subv := viper.Sub(remoteHost)
+
+	if subv == nil {
+		subv = viper.GetViper()
+	}
+
+	utils.Logger.Debug("Parsed User:", user)
+	utils.Logger.Debug("Parsed Remote Host:", remoteHost)
+
+	if user != "" {
+		subv.Set("User", user)
+	}
+
+	subv.SetDefault("RemoteHost", remoteHost)
+
+	return subv
 }
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
 
-	serverCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Set local bind address and port")
+	serverCmd.Flags().StringArrayVar(&bindAddresses, "bind", []string{server.DefaultBindAddress}, "Set local listener as [protocol://][user:password@]address[/target], can be repeated")
 	serverCmd.Flags().StringVarP(&idFile, "identity_file", "i", "", "Path to private key")
 	serverCmd.Flags().StringVarP(&remoteExecutable, "remote_executable", "", "", "Path to SaSSHimi to run on remote machine")
+	serverCmd.Flags().StringVar(&policyFile, "policy", "", "Path to destination allow/deny policy file")
+	serverCmd.Flags().IntVar(&poolSize, "pool-size", 1, "Number of parallel tunnels to the remote host")
+	serverCmd.Flags().StringVar(&balance, "balance", "round-robin", "Balance strategy for parallel tunnels (round-robin, least-streams, latency)")
+	serverCmd.Flags().StringVar(&controlSocket, "control", "", "Serve the control API at this unix socket (default "+server.DefaultControlSocket+" if no value given)")
+	serverCmd.Flags().Lookup("control").NoOptDefVal = server.DefaultControlSocket
+	serverCmd.Flags().StringVar(&metricsAddress, "metrics-listen", "", "Serve Prometheus metrics at http://address/metrics")
+	serverCmd.Flags().BoolVar(&dashboard, "tui", false, "Show a live dashboard of tunnels and streams")
+	serverCmd.Flags().StringVar(&auditLog, "audit-log", "", "Write an audit record per connection to this file, or to syslog[://host:port]")
+	serverCmd.Flags().StringVar(&captureFile, "capture", "", "Record the payload of the streams to this pcapng file")
+	serverCmd.Flags().StringVar(&uploadLimit, "upload-limit", "", "Limit the data sent through each tunnel, in bytes per second with K, M or G suffix")
+	serverCmd.Flags().StringVar(&downloadLimit, "download-limit", "", "Limit the data received through each tunnel")
+	serverCmd.Flags().StringVar(&streamUploadLimit, "stream-upload-limit", "", "Limit the data sent by each stream")
+	serverCmd.Flags().StringVar(&streamDownloadLimit, "stream-download-limit", "", "Limit the data received by each stream")
+	serverCmd.Flags().IntVar(&maxStreams, "max-streams", 0, "Refuse new connections while this many streams are open")
+	serverCmd.Flags().IntVar(&maxStreamsPerClient, "max-streams-per-client", 0, "Refuse new connections while this many streams of the same client IP are open")
+	serverCmd.Flags().StringVar(&idleTimeout, "idle-timeout", "", "Close the streams without traffic for this long, as 30s, 10m or 1h")
+	serverCmd.Flags().StringVar(&maxLifetime, "max-lifetime", "", "Close the streams open for longer than this")
+	serverCmd.Flags().StringSliceVar(&uploadMethods, "upload-methods", nil, "Methods to upload the agent, tried in order (default cat,base64,printf,sftp,scp)")
+	serverCmd.Flags().StringSliceVar(&remoteDirectories, "remote-dirs", nil, "Remote directories for the agent, the first writable and executable one is used (default $HOME,/tmp,/dev/shm,$XDG_RUNTIME_DIR)")
+	serverCmd.Flags().StringVar(&agentDir, "agent-dir", server.DefaultAgentDir, "Directory with the agent builds to upload, named SaSSHimi-agent_<os>_<arch> or SaSSHimi_<os>_<arch>")
+	serverCmd.Flags().BoolVar(&agentCache, "agent-cache", false, "Keep the agent in a remote cache and reuse it when identical")
+	serverCmd.Flags().BoolVar(&filelessAgent, "fileless", false, "Run the agent from memory on Linux hosts, uploading it if that is not possible")
+	serverCmd.Flags().BoolVar(&compressAgent, "compress-agent", false, "Upload the agent compressed when the remote host has gzip")
+	serverCmd.Flags().StringVar(&persistAgent, "persist", "", "Keep the remote streams for this long, as 30s or 10m, when the connection is lost, and reattach to them")
+	serverCmd.Flags().StringVar(&upstreamProxy, "upstream-proxy", "", "Make the agent dial through this proxy, as http://[user:pass@]host:port or socks5[h]://..., or env for the one in its environment")
+	serverCmd.Flags().StringSliceVar(&noProxy, "no-proxy", nil, "Destinations the agent dials directly despite the upstream proxy, as the policy hosts")
+	serverCmd.Flags().StringSliceVar(&dnsServers, "dns-server", nil, "Name servers of the agent, as [udp://|tcp://|tls://]host[:port], tls being DNS over TLS")
+	serverCmd.Flags().StringVar(&resolveNames, "resolve", "remote", "Where the destination names are resolved, remote by the agent or local")
+	serverCmd.Flags().BoolVar(&agentHttp, "agent-http", false, "Run the agent as an HTTP proxy, opening the streams with CONNECT")
 }
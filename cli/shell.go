@@ -0,0 +1,96 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+	"net/url"
+	"os"
+)
+
+var shellHost string
+
+// shellCmd represents the shell command
+var shellCmd = &cobra.Command{
+	Use:   "shell [--host host_id] [-- command [args...]]",
+	Short: "Open an interactive shell on the remote host through the agent of a running server",
+	Long: `Open an interactive shell, or run a command, on a pseudo terminal of the remote host. It goes through the
+control socket of a running server and the agent of one of its tunnels, without a new SSH session.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		// Errors come from the server, not from a wrong usage
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "/exec"
+		if shellHost != "" {
+			path += "?host=" + url.QueryEscape(shellHost)
+		}
+
+		tty := &common.TtyRequest{Term: os.Getenv("TERM"), Rows: 24, Cols: 80}
+		if tty.Term == "" {
+			tty.Term = "xterm"
+		}
+		if rows, cols, ok := terminalSize(); ok {
+			tty.Rows, tty.Cols = rows, cols
+		}
+
+		conn, err := ctlUpgrade(path, common.ExecRequest{Command: args, Tty: tty}, server.ExecProtocol)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		// Keys like Ctrl-C go to the remote terminal
+		termios := server.TermiosSaveStdin()
+		if terminal.IsTerminal(int(os.Stdin.Fd())) {
+			if err := server.TermiosMakeRawStdin(); err != nil {
+				fmt.Fprintln(os.Stderr, "Unable to put the terminal in raw mode: "+err.Error())
+			}
+		}
+
+		status, err := relayExec(conn, true)
+		server.TermiosRestoreStdin(termios)
+		if err != nil {
+			return err
+		}
+
+		os.Exit(status)
+		return nil
+	},
+}
+
+// terminalSize returns the rows and columns of the terminal of stdout.
+func terminalSize() (uint16, uint16, bool) {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 0, 0, false
+	}
+
+	return uint16(height), uint16(width), true
+}
+
+func init() {
+	rootCmd.AddCommand(shellCmd)
+
+	// Flags after the command are its own
+	shellCmd.Flags().SetInterspersed(false)
+	shellCmd.Flags().StringVar(&ctlSocket, "control", server.DefaultControlSocket, "Path to the control socket of the server")
+	shellCmd.Flags().StringVar(&shellHost, "host", "", "Host section of the tunnels to open the shell through, the default ones if empty")
+}
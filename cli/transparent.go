@@ -17,6 +17,7 @@ package cli
 import (
 	"github.com/rsrdesarrollo/SaSSHimi/server"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 
@@ -26,14 +27,37 @@ var transparentCmd = &cobra.Command{
 	Long:  ``,
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		viper.SetDefault("Policy", policyFile)
+		viper.SetDefault("MetricsListen", metricsAddress)
+		viper.SetDefault("AuditLog", auditLog)
+		viper.SetDefault("Capture", captureFile)
+		viper.SetDefault("Upstream.Proxy", upstreamProxy)
+		viper.SetDefault("Upstream.NoProxy", noProxy)
+		viper.SetDefault("DNS.Servers", dnsServers)
+		viper.SetDefault("DNS.Resolve", resolveNames)
+		viper.SetDefault("AgentHttp", agentHttp)
 
-		server.RunTransparent(args, bindAddress)
+		binds := bindAddresses
+		if !cmd.Flags().Changed("bind") && viper.IsSet("Listeners") {
+			binds = nil
+		}
+
+		server.RunTransparent(viper.GetViper(), args, binds)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(transparentCmd)
 
-	transparentCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Set local bind address and port")
+	transparentCmd.Flags().StringArrayVar(&bindAddresses, "bind", []string{server.DefaultBindAddress}, "Set local listener as [protocol://][user:password@]address[/target], can be repeated")
 	transparentCmd.Flags().StringVarP(&idFile, "identity_file", "i", "", "Path to private key")
+	transparentCmd.Flags().StringVar(&policyFile, "policy", "", "Path to destination allow/deny policy file")
+	transparentCmd.Flags().StringVar(&metricsAddress, "metrics-listen", "", "Serve Prometheus metrics at http://address/metrics")
+	transparentCmd.Flags().StringVar(&auditLog, "audit-log", "", "Write an audit record per connection to this file, or to syslog[://host:port]")
+	transparentCmd.Flags().StringVar(&captureFile, "capture", "", "Record the payload of the streams to this pcapng file")
+	transparentCmd.Flags().StringVar(&upstreamProxy, "upstream-proxy", "", "Make the agent dial through this proxy, as http://[user:pass@]host:port or socks5[h]://..., or env for the one in its environment")
+	transparentCmd.Flags().StringSliceVar(&noProxy, "no-proxy", nil, "Destinations the agent dials directly despite the upstream proxy, as the policy hosts")
+	transparentCmd.Flags().StringSliceVar(&dnsServers, "dns-server", nil, "Name servers of the agent, as [udp://|tcp://|tls://]host[:port], tls being DNS over TLS")
+	transparentCmd.Flags().StringVar(&resolveNames, "resolve", "remote", "Where the destination names are resolved, remote by the agent or local")
+	transparentCmd.Flags().BoolVar(&agentHttp, "agent-http", false, "The agent of the command serves HTTP (agent --use-http), open the streams with CONNECT")
 }
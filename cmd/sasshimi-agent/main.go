@@ -0,0 +1,104 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command sasshimi-agent is the remote side of SaSSHimi alone, much smaller
+// than the whole tool. It takes the same arguments the server gives to
+// "SaSSHimi agent".
+package main
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/agent"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `Usage:
+  sasshimi-agent agent [-v...] [--use-http] [-k|--keep-binary] [--fileless] [--manifest file]
+                       [--persist duration --session socket] [--attach socket]`
+
+func main() {
+	if len(os.Args) < 2 {
+		fail(usage)
+	}
+
+	switch os.Args[1] {
+	case "agent":
+		runAgent(os.Args[2:])
+	default:
+		fail(usage)
+	}
+}
+
+func runAgent(args []string) {
+	options := agent.Options{}
+	verboseLevel := 0
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--use-http":
+			options.UseHttpProxy = true
+		case arg == "-k" || arg == "--keep-binary":
+			options.KeepBinary = true
+		case arg == "--fileless":
+			options.Fileless = true
+		case arg == "--manifest" && i+1 < len(args):
+			i++
+			options.Manifest = args[i]
+		case strings.HasPrefix(arg, "--manifest="):
+			options.Manifest = strings.TrimPrefix(arg, "--manifest=")
+		case arg == "--persist" && i+1 < len(args):
+			i++
+			persist, err := time.ParseDuration(args[i])
+			if err != nil {
+				fail("invalid --persist: " + err.Error())
+			}
+			options.Persist = persist
+		case arg == "--session" && i+1 < len(args):
+			i++
+			options.Session = args[i]
+		case arg == "--daemon":
+			options.Daemon = true
+		case arg == "--attach" && i+1 < len(args):
+			i++
+			options.Attach = args[i]
+		case arg == "--verbose":
+			verboseLevel++
+		case len(arg) > 1 && strings.Trim(arg[1:], "v") == "" && arg[0] == '-':
+			verboseLevel += len(arg) - 1
+		default:
+			fail("unknown option " + arg + "\n" + usage)
+		}
+	}
+
+	// The server sets the log format and levels in the environment
+	err := utils.SetupLogging(utils.LogConfig{
+		Format:  os.Getenv("LOGFORMAT"),
+		Verbose: verboseLevel,
+		Levels:  os.Getenv("LOGLEVEL"),
+	})
+	if err != nil {
+		fail(err.Error())
+	}
+
+	agent.Run(options)
+}
+
+func fail(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(2)
+}
@@ -1,16 +1,23 @@
 package common
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"github.com/rsrdesarrollo/SaSSHimi/metrics"
 	"github.com/rsrdesarrollo/SaSSHimi/utils"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var logger = utils.NewLogger("common")
+
 type ChannelForwarder struct {
+	// Name identifies the tunnel in metrics
+	Name        string
 	InChannel   chan *DataMessage
-	OutChannel  chan *DataMessage
+	OutQueue    *Scheduler
 	Reader      io.Reader
 	Writer      io.Writer
 	ChannelOpen bool
@@ -19,20 +26,30 @@ type ChannelForwarder struct {
 
 	Clients     map[string]*Client
 	ClientsLock *sync.Mutex
+
+	// Limits of the data read from clients, for all of them and for each one
+	readLimit       *TokenBucket
+	streamReadLimit int64
+
+	rtt int64
+
+	// Set on resumable channels
+	resume *resumeLog
 }
 
 func (c *ChannelForwarder) ReadInputData() {
 	decoder := gob.NewDecoder(c.Reader)
 
-	utils.Logger.Debug("Reading from io.Reader to InChannel")
+	logger.Debug("Reading from io.Reader to InChannel")
 
 	for c.ChannelOpen {
 		var inMsg DataMessage
 		err := decoder.Decode(&inMsg)
 		if err != nil {
-			utils.Logger.Error("Read ERROR: ", err)
+			logger.Error("Read ERROR: ", err)
 			break
 		}
+		metrics.Messages.With(c.Name, "in", inMsg.Type()).Inc()
 		c.InChannel <- &inMsg
 	}
 
@@ -42,16 +59,21 @@ func (c *ChannelForwarder) ReadInputData() {
 func (c *ChannelForwarder) WriteOutputData() {
 	encoder := gob.NewEncoder(c.Writer)
 
-	utils.Logger.Debug("Writing from OutChannel to io.Writer")
+	logger.Debug("Writing from OutQueue to io.Writer")
 
 	for c.ChannelOpen {
-		outMsg := <-c.OutChannel
+		outMsg := c.OutQueue.Next()
+		if outMsg == nil {
+			break
+		}
+
 		err := encoder.Encode(outMsg)
 
 		if err != nil {
-			utils.Logger.Error("Write ERROR: ", err)
+			logger.Error("Write ERROR: ", err)
 			break
 		}
+		metrics.Messages.With(c.Name, "out", outMsg.Type()).Inc()
 	}
 
 	c.Close()
@@ -59,13 +81,46 @@ func (c *ChannelForwarder) WriteOutputData() {
 
 func (c *ChannelForwarder) Close() {
 	c.ChannelOpen = false
+	c.OutQueue.Close()
 }
 
 func (c *ChannelForwarder) Terminate() {
 	msg := NewMessage("", nil)
 	msg.CloseChannel = true
 
-	c.OutChannel <- msg
+	c.OutQueue.Send(msg)
+}
+
+func (c *ChannelForwarder) SendSettings(settings *AgentSettings) {
+	msg := NewMessage("", nil)
+	msg.Settings = settings
+
+	c.OutQueue.Send(msg)
+}
+
+// SetReadLimits limits, in bytes per second, the data read from the clients
+// before it is sent through the channel. Zero means unlimited.
+func (c *ChannelForwarder) SetReadLimits(total int64, stream int64) {
+	c.ClientsLock.Lock()
+	defer c.ClientsLock.Unlock()
+
+	if c.readLimit == nil {
+		c.readLimit = NewTokenBucket(total)
+	} else {
+		c.readLimit.SetRate(total)
+	}
+
+	c.streamReadLimit = stream
+	for _, client := range c.Clients {
+		client.streamLimit.SetRate(stream)
+	}
+}
+
+// LimitClient applies the read limits to a new client. It must be called
+// with ClientsLock held, before the client starts reading.
+func (c *ChannelForwarder) LimitClient(client *Client) {
+	client.tunnelLimit = c.readLimit
+	client.streamLimit = NewTokenBucket(c.streamReadLimit)
 }
 
 func (c *ChannelForwarder) KeepAlive(){
@@ -76,8 +131,32 @@ func (c *ChannelForwarder) KeepAlive(){
 }
 
 func (c *ChannelForwarder) sendKeepAlive() {
-	msg := NewMessage("", nil)
+	msg := NewMessage("", binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
 	msg.KeepAlive = true
 
-	c.OutChannel <- msg
+	c.OutQueue.Send(msg)
+}
+
+// AckKeepAlive echoes a keep alive back so the peer can measure the round trip.
+func (c *ChannelForwarder) AckKeepAlive(keepAlive *DataMessage) {
+	msg := NewMessage("", keepAlive.Data)
+	msg.KeepAliveAck = true
+
+	c.OutQueue.Send(msg)
+}
+
+func (c *ChannelForwarder) UpdateRTT(keepAliveAck *DataMessage) {
+	if len(keepAliveAck.Data) != 8 {
+		return
+	}
+
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(keepAliveAck.Data)))
+	rtt := time.Since(sent)
+	atomic.StoreInt64(&c.rtt, int64(rtt))
+	metrics.KeepAliveRTT.With(c.Name).Set(rtt.Seconds())
+}
+
+// RTT returns the last keep alive round trip time, or zero if still unknown.
+func (c *ChannelForwarder) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
 }
@@ -15,77 +15,205 @@
 package common
 
 import (
+	"github.com/rsrdesarrollo/SaSSHimi/metrics"
 	"github.com/rsrdesarrollo/SaSSHimi/utils"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Recorder receives a copy of the data of a client, as it is read from its
+// connection (sent) and written to it (received).
+type Recorder interface {
+	Sent(data []byte)
+	Received(data []byte)
+	Close()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
 type Client struct {
-	Id           string
-	conn         net.Conn
-	outChann     chan *DataMessage
-	inChann      chan *DataMessage
-	readyToClose bool
-	isDead       bool
-	clientMutex  *sync.Mutex
+	Id          string
+	Destination string
+	Priority    Priority
+	// Streams of remote commands, which may stay idle as long as they run
+	Exec        bool
+	conn        net.Conn
+	out         *Scheduler
+	inChann     chan *DataMessage
+	readClosed  bool
+	writeClosed bool
+	isDead      bool
+	clientMutex *sync.Mutex
+
+	created       time.Time
+	lastActivity  int64
+	bytesSent     uint64
+	bytesReceived uint64
+	recorder      Recorder
+
+	// Limits of the data read from the connection
+	tunnelLimit *TokenBucket
+	streamLimit *TokenBucket
 }
 
 func (c *Client) IsDead() bool {
 	return c.isDead
 }
 
+// ReadyToClose tells if one of the directions of the stream is finished.
 func (c *Client) ReadyToClose() bool {
-	return c.readyToClose
+	c.clientMutex.Lock()
+	defer c.clientMutex.Unlock()
+
+	return c.readClosed || c.writeClosed
 }
 
-func (c *Client) SetReadyToClose(readyToClose bool) {
-	c.readyToClose = readyToClose
+// State describes the stream as open, half-closed (one end finished) or dead.
+func (c *Client) State() string {
+	switch {
+	case c.isDead:
+		return "dead"
+	case c.ReadyToClose():
+		return "half-closed"
+	default:
+		return "open"
+	}
 }
 
-func NewClient(id string, conn net.Conn, outChannel chan *DataMessage) *Client {
+// LogFields identifies the stream in structured logs.
+func (c *Client) LogFields() utils.Fields {
+	fields := utils.Fields{"stream": c.Id}
+	if c.Destination != "" {
+		fields["destination"] = c.Destination
+	}
+	return fields
+}
+
+// SetRecorder starts copying the data of the client to recorder.
+func (c *Client) SetRecorder(recorder Recorder) {
+	c.clientMutex.Lock()
+	c.recorder = recorder
+	c.clientMutex.Unlock()
+}
+
+func (c *Client) getRecorder() Recorder {
+	c.clientMutex.Lock()
+	defer c.clientMutex.Unlock()
+
+	return c.recorder
+}
+
+func (c *Client) Age() time.Duration {
+	return time.Since(c.created)
+}
+
+// Idle returns the time since data was last read or written.
+func (c *Client) Idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// BytesSent returns the bytes read from the connection and sent to the channel.
+func (c *Client) BytesSent() uint64 {
+	return atomic.LoadUint64(&c.bytesSent)
+}
+
+// BytesReceived returns the bytes received from the channel and written to the connection.
+func (c *Client) BytesReceived() uint64 {
+	return atomic.LoadUint64(&c.bytesReceived)
+}
+
+func NewClient(id string, conn net.Conn, out *Scheduler) *Client {
 	return &Client{
 		Id:           id,
 		conn:         conn,
-		outChann:     outChannel,
-		readyToClose: false,
+		out:          out,
 		clientMutex:  &sync.Mutex{},
+		created:      time.Now(),
+		lastActivity: time.Now().UnixNano(),
 	}
 }
 
 func (c *Client) Terminate() {
 	c.isDead = true
 	c.conn.Close()
+
+	if recorder := c.getRecorder(); recorder != nil {
+		recorder.Close()
+	}
 }
 
-func (c *Client) Close() {
-	var mustBeClosed bool
+// CloseWrite handles the half-close of the peer, which will send nothing
+// else: the connection is closed for writing, so its end gets EOF, while it
+// is still read. It returns true if the stream is then closed both ways.
+func (c *Client) CloseWrite() bool {
+	if conn, ok := c.conn.(closeWriter); ok {
+		conn.CloseWrite()
+	}
 
+	return c.closeDirection(false)
+}
+
+// closeDirection marks the reading (EOF read, half-close sent) or the writing
+// (half-close received) direction as finished, and closes the connection
+// once both are. It returns true if that happened now.
+func (c *Client) closeDirection(reading bool) bool {
 	c.clientMutex.Lock()
-	if c.ReadyToClose() {
-		mustBeClosed = true
+	if reading {
+		c.readClosed = true
 	} else {
-		mustBeClosed = false
-		c.readyToClose = true
-
-		utils.Logger.Debug("First attempt to close", c.Id)
+		c.writeClosed = true
 	}
+	closed := c.readClosed && c.writeClosed
 	c.clientMutex.Unlock()
 
-	if mustBeClosed {
-		utils.Logger.Debug("Really closing", c.Id)
-		c.conn.Close()
+	if !closed {
+		logger.Debug("First direction closed", c.Id)
+		return false
+	}
+
+	logger.Debug("Really closing", c.Id)
+	c.conn.Close()
+
+	if recorder := c.getRecorder(); recorder != nil {
+		recorder.Close()
 	}
 
+	return true
 }
 
 func (c *Client) Write(data []byte) error {
+	if recorder := c.getRecorder(); recorder != nil {
+		recorder.Received(data)
+	}
+
+	c.touch()
+
 	var writed = 0
+
+	// Counted ahead, as the reader of a pipe gets the data before Write
+	// returns, and corrected if not fully written
+	atomic.AddUint64(&c.bytesReceived, uint64(len(data)))
+	defer func() {
+		if writed < len(data) {
+			atomic.AddUint64(&c.bytesReceived, -uint64(len(data)-writed))
+		}
+	}()
+
 	for writed < len(data) {
 		wn, err := c.conn.Write(data)
 		writed += wn
+		metrics.ClientBytes.With("received").Add(float64(wn))
 
 		if writed < len(data) {
-			utils.Logger.Debugf("******* Need second write of %d bytes on client %s", len(data)-writed, c.Id)
+			logger.Debugf("******* Need second write of %d bytes on client %s", len(data)-writed, c.Id)
 		}
 
 		if err != nil {
@@ -97,24 +225,51 @@ func (c *Client) Write(data []byte) error {
 
 func (c *Client) NotifyEOF(isDead bool) {
 	msg := NewMessage(c.Id, []byte{})
+	msg.Priority = c.Priority
 	if !isDead {
 		msg.CloseClient = true
 	} else {
 		msg.DeadClient = isDead
 	}
-	c.outChann <- msg
+	c.out.Send(msg)
 }
 
-func (c *Client) ReadFromClientToChannel() {
+func (c *Client) notifyHalfClose() {
+	msg := NewMessage(c.Id, []byte{})
+	msg.Priority = c.Priority
+	msg.HalfClose = true
+	c.out.Send(msg)
+}
+
+// ReadFromClientToChannel sends the data of the connection to the channel
+// until EOF, when the peer is told that this direction is finished. It
+// returns true if the stream is then closed both ways.
+func (c *Client) ReadFromClientToChannel() bool {
 	for {
 		data := make([]byte, 1024)
 		readed, err := c.conn.Read(data)
 		if err != nil {
-			c.Close()
-			c.NotifyEOF(false)
-			break
+			// Terminated clients have already notified their peer
+			if c.IsDead() {
+				return false
+			}
+			c.notifyHalfClose()
+			return c.closeDirection(true)
 		}
 
-		c.outChann <- NewMessage(c.Id, data[:readed])
+		// Throttle before the data is queued
+		c.streamLimit.Wait(readed)
+		c.tunnelLimit.Wait(readed)
+
+		c.touch()
+		atomic.AddUint64(&c.bytesSent, uint64(readed))
+		metrics.ClientBytes.With("sent").Add(float64(readed))
+
+		if recorder := c.getRecorder(); recorder != nil {
+			recorder.Sent(data[:readed])
+		}
+		msg := NewMessage(c.Id, data[:readed])
+		msg.Priority = c.Priority
+		c.out.Send(msg)
 	}
 }
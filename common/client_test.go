@@ -0,0 +1,105 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// forward delivers the messages of a stream to its peer on the other end of
+// the tunnel, as the server and the agent do.
+func forward(out *Scheduler, peer *Client) {
+	for {
+		msg := out.Next()
+		if msg == nil {
+			return
+		}
+
+		if msg.HalfClose {
+			peer.CloseWrite()
+		} else if len(msg.Data) > 0 {
+			peer.Write(msg.Data)
+		}
+	}
+}
+
+func readAll(t *testing.T, conn io.Reader) string {
+	result := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(conn)
+		result <- string(data)
+	}()
+
+	select {
+	case data := <-result:
+		return data
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for EOF")
+		return ""
+	}
+}
+
+func TestHalfCloseRoundTrip(t *testing.T) {
+	local, localEnd := Pipe()
+	remote, remoteEnd := Pipe()
+
+	localOut, remoteOut := NewScheduler(), NewScheduler()
+	defer localOut.Close()
+	defer remoteOut.Close()
+
+	localClient := NewClient("stream", localEnd, localOut)
+	remoteClient := NewClient("stream", remoteEnd, remoteOut)
+
+	go forward(localOut, remoteClient)
+	go forward(remoteOut, localClient)
+
+	closed := make(chan bool, 2)
+	go func() { closed <- localClient.ReadFromClientToChannel() }()
+	go func() { closed <- remoteClient.ReadFromClientToChannel() }()
+
+	// The request is finished by EOF, as HTTP/1.0 clients or shell pipes do
+	local.Write([]byte("request"))
+	local.CloseWrite()
+
+	if data := readAll(t, remote); data != "request" {
+		t.Fatalf("remote read %q, want request", data)
+	}
+
+	// The response still flows back after the EOF reached the remote side
+	remote.Write([]byte("response"))
+	remote.CloseWrite()
+
+	if data := readAll(t, local); data != "response" {
+		t.Fatalf("local read %q, want response", data)
+	}
+
+	fullyClosed := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case done := <-closed:
+			if done {
+				fullyClosed++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the streams to finish reading")
+		}
+	}
+
+	if fullyClosed != 1 {
+		t.Errorf("%d readers closed the stream both ways, want 1", fullyClosed)
+	}
+}
@@ -31,4 +31,46 @@ type DataMessage struct {
 	Data         []byte
 	CloseChannel bool
 	KeepAlive    bool
+	KeepAliveAck bool
+	Settings     *AgentSettings
+	// Class of the stream, so both ends schedule it the same way
+	Priority Priority
+	// The sender has finished writing to the stream, but still reads it
+	HalfClose bool
+	// Sequence of the message and last sequence received by the sender, on
+	// resumable channels only
+	Seq uint64
+	Ack uint64
+	// First message through a new transport of a resumable channel
+	Resume bool
+	// First message of a stream that runs a command on the agent
+	Exec *ExecRequest
+}
+
+// Type names the kind of message, for logs and metrics.
+func (m *DataMessage) Type() string {
+	switch {
+	case m.Resume:
+		return "resume"
+	case m.Seq == 0 && m.Ack != 0:
+		return "ack"
+	case m.Settings != nil:
+		return "settings"
+	case m.Exec != nil:
+		return "exec"
+	case m.KeepAlive:
+		return "keepalive"
+	case m.KeepAliveAck:
+		return "keepalive_ack"
+	case m.CloseChannel:
+		return "close_channel"
+	case m.DeadClient:
+		return "dead_client"
+	case m.CloseClient:
+		return "close_client"
+	case m.HalfClose:
+		return "half_close"
+	default:
+		return "data"
+	}
 }
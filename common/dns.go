@@ -0,0 +1,200 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	ResolveRemote = "remote"
+	ResolveLocal  = "local"
+)
+
+// DNSSettings configures how the agent resolves the destination names.
+type DNSSettings struct {
+	// Name servers as [udp://|tcp://|tls://]host[:port], tried in turn, tls
+	// being DNS over TLS. The system resolver is used if empty
+	Servers []string
+	// Addresses of names, looked up before the name servers
+	Hosts map[string]string
+}
+
+func (d *DNSSettings) Validate() error {
+	for _, server := range d.Servers {
+		if _, _, err := parseNameServer(server); err != nil {
+			return err
+		}
+	}
+
+	for name, address := range d.Hosts {
+		if net.ParseIP(address) == nil {
+			return errors.New("invalid address " + address + " for " + name)
+		}
+	}
+
+	return nil
+}
+
+// parseNameServer returns the network and the address of a name server.
+func parseNameServer(server string) (string, string, error) {
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return "", "", errors.New("invalid name server: " + err.Error())
+	}
+
+	defaultPort := map[string]string{"udp": "53", "tcp": "53", "tls": "853"}
+	port, prs := defaultPort[serverURL.Scheme]
+	if !prs {
+		return "", "", errors.New("unsupported name server scheme " + serverURL.Scheme)
+	}
+	if serverURL.Hostname() == "" {
+		return "", "", errors.New("name server without host: " + server)
+	}
+	if serverURL.Port() != "" {
+		port = serverURL.Port()
+	}
+
+	return serverURL.Scheme, net.JoinHostPort(serverURL.Hostname(), port), nil
+}
+
+// Resolver looks up names in a static map and then with the given name
+// servers, or the system resolver. A nil Resolver is the system resolver.
+type Resolver struct {
+	hosts    map[string]net.IP
+	resolver *net.Resolver
+}
+
+func NewResolver(settings *DNSSettings) *Resolver {
+	r := &Resolver{
+		hosts:    make(map[string]net.IP),
+		resolver: net.DefaultResolver,
+	}
+
+	if settings == nil {
+		return r
+	}
+
+	for name, address := range settings.Hosts {
+		r.hosts[strings.ToLower(strings.TrimSuffix(name, "."))] = net.ParseIP(address)
+	}
+
+	type nameServer struct{ network, address string }
+	var servers []nameServer
+	for _, server := range settings.Servers {
+		if network, address, err := parseNameServer(server); err == nil {
+			servers = append(servers, nameServer{network, address})
+		}
+	}
+
+	if len(servers) == 0 {
+		return r
+	}
+
+	// The Go resolver retries with the next server of resolv.conf, use the
+	// next of ours instead
+	var next uint32
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			server := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			dialer := &net.Dialer{}
+
+			switch server.network {
+			case "tls":
+				host, _, _ := net.SplitHostPort(server.address)
+				conn, err := dialer.DialContext(ctx, "tcp", server.address)
+				if err != nil {
+					return nil, err
+				}
+				// A stream connection, so messages are framed as on TCP
+				tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			case "tcp":
+				return dialer.DialContext(ctx, "tcp", server.address)
+			default:
+				// TCP if asked, for truncated answers
+				return dialer.DialContext(ctx, network, server.address)
+			}
+		},
+	}
+
+	return r
+}
+
+// LookupIP returns an address of name, IPv4 preferred.
+func (r *Resolver) LookupIP(ctx context.Context, name string) (net.IP, error) {
+	if r == nil {
+		r = NewResolver(nil)
+	}
+
+	if ip := r.Static(name); ip != nil {
+		return ip, nil
+	}
+
+	addrs, err := r.resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP, nil
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no address for " + name)
+	}
+
+	return addrs[0].IP, nil
+}
+
+// Static returns the address of name in the static map, or nil.
+func (r *Resolver) Static(name string) net.IP {
+	if r == nil {
+		return nil
+	}
+
+	return r.hosts[strings.ToLower(strings.TrimSuffix(name, "."))]
+}
+
+// ResolveAddr replaces the name of a host:port address by its address.
+func (r *Resolver) ResolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, err
+	}
+
+	ip, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(ip.String(), port), nil
+}
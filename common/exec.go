@@ -0,0 +1,113 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// ExecRequest asks the agent to run a command for a new stream, instead of
+// connecting it to its proxy. The data of the stream are then exec frames.
+type ExecRequest struct {
+	// Command and arguments, the login shell if empty and on a terminal
+	Command []string
+	// Run on a pseudo terminal if set
+	Tty *TtyRequest
+}
+
+type TtyRequest struct {
+	Term string
+	Rows uint16
+	Cols uint16
+}
+
+// Kinds of the exec frames
+const (
+	// Input of the process, an empty one closes it
+	ExecStdin byte = iota
+	ExecStdout
+	ExecStderr
+	// Exit status of the process, as a big endian int32, the last frame
+	ExecExit
+	// New size of the terminal, as big endian uint16 rows and columns
+	ExecResize
+	// Name of a signal for the process, as in SSH: INT, TERM, HUP...
+	ExecSignal
+)
+
+const maxExecFrame = 1 << 20
+
+// WriteExecFrame writes a frame with a single write, so writers sharing w
+// only need to serialize their calls.
+func WriteExecFrame(w io.Writer, kind byte, data []byte) error {
+	if len(data) > maxExecFrame {
+		return errors.New("exec frame too big: " + strconv.Itoa(len(data)))
+	}
+
+	frame := make([]byte, 5, 5+len(data))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+func ReadExecFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxExecFrame {
+		return 0, nil, errors.New("exec frame too big: " + strconv.Itoa(int(size)))
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], data, nil
+}
+
+// ExitStatusData encodes status for an ExecExit frame.
+func ExitStatusData(status int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(int32(status)))
+}
+
+// ExitStatus decodes the data of an ExecExit frame, -1 if invalid.
+func ExitStatus(data []byte) int {
+	if len(data) != 4 {
+		return -1
+	}
+	return int(int32(binary.BigEndian.Uint32(data)))
+}
+
+// WindowSizeData encodes a terminal size for an ExecResize frame.
+func WindowSizeData(rows uint16, cols uint16) []byte {
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, rows), cols)
+}
+
+// WindowSize decodes the data of an ExecResize frame, zero if invalid.
+func WindowSize(data []byte) (uint16, uint16) {
+	if len(data) != 4 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:])
+}
@@ -0,0 +1,94 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestExecFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		kind byte
+		data []byte
+	}{
+		{"empty stdin closes", ExecStdin, []byte{}},
+		{"stdout", ExecStdout, []byte("hello\n")},
+		{"stderr", ExecStderr, []byte("error\n")},
+		{"exit status", ExecExit, ExitStatusData(-1)},
+		{"resize", ExecResize, WindowSizeData(24, 80)},
+		{"signal", ExecSignal, []byte("TERM")},
+		{"largest frame", ExecStdout, bytes.Repeat([]byte{'x'}, maxExecFrame)},
+	}
+
+	stream := &bytes.Buffer{}
+	for _, test := range tests {
+		if err := WriteExecFrame(stream, test.kind, test.data); err != nil {
+			t.Fatalf("%s: WriteExecFrame failed: %s", test.name, err.Error())
+		}
+	}
+
+	for _, test := range tests {
+		kind, data, err := ReadExecFrame(stream)
+		if err != nil {
+			t.Fatalf("%s: ReadExecFrame failed: %s", test.name, err.Error())
+		}
+		if kind != test.kind || !bytes.Equal(data, test.data) {
+			t.Errorf("%s: read kind %d and %d bytes, want kind %d and %d bytes", test.name, kind, len(data), test.kind, len(test.data))
+		}
+	}
+
+	if _, _, err := ReadExecFrame(stream); err != io.EOF {
+		t.Errorf("ReadExecFrame at the end = %v, want EOF", err)
+	}
+}
+
+func TestExecFrameLimit(t *testing.T) {
+	if err := WriteExecFrame(io.Discard, ExecStdout, make([]byte, maxExecFrame+1)); err == nil {
+		t.Error("WriteExecFrame over the limit must fail")
+	}
+
+	header := []byte{ExecStdout, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[1:], maxExecFrame+1)
+	if _, _, err := ReadExecFrame(bytes.NewReader(header)); err == nil {
+		t.Error("ReadExecFrame over the limit must fail")
+	}
+
+	truncated := []byte{ExecStdout, 0, 0, 0, 10, 'a'}
+	if _, _, err := ReadExecFrame(bytes.NewReader(truncated)); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadExecFrame of a truncated frame = %v, want unexpected EOF", err)
+	}
+}
+
+func TestExecFrameData(t *testing.T) {
+	for _, status := range []int{0, 1, 127, 143, -1} {
+		if got := ExitStatus(ExitStatusData(status)); got != status {
+			t.Errorf("ExitStatus(ExitStatusData(%d)) = %d", status, got)
+		}
+	}
+	if got := ExitStatus([]byte{1}); got != -1 {
+		t.Errorf("ExitStatus of invalid data = %d, want -1", got)
+	}
+
+	if rows, cols := WindowSize(WindowSizeData(50, 132)); rows != 50 || cols != 132 {
+		t.Errorf("WindowSize(WindowSizeData(50, 132)) = %d, %d", rows, cols)
+	}
+	if rows, cols := WindowSize(nil); rows != 0 || cols != 0 {
+		t.Errorf("WindowSize of invalid data = %d, %d, want zero", rows, cols)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// PipeConn is one end of an in-memory connection created by Pipe.
+type PipeConn struct {
+	reader     *io.PipeReader
+	writer     *io.PipeWriter
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// Pipe works like net.Pipe but each end can CloseWrite to send EOF to its
+// peer while still reading what the peer writes.
+func Pipe() (*PipeConn, *PipeConn) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	return &PipeConn{reader: r1, writer: w2, localAddr: pipeAddr{}, remoteAddr: pipeAddr{}},
+		&PipeConn{reader: r2, writer: w1, localAddr: pipeAddr{}, remoteAddr: pipeAddr{}}
+}
+
+func (p *PipeConn) Read(data []byte) (int, error) {
+	return p.reader.Read(data)
+}
+
+func (p *PipeConn) Write(data []byte) (int, error) {
+	return p.writer.Write(data)
+}
+
+func (p *PipeConn) CloseWrite() error {
+	return p.writer.Close()
+}
+
+func (p *PipeConn) Close() error {
+	p.writer.Close()
+	return p.reader.Close()
+}
+
+func (p *PipeConn) SetAddrs(local net.Addr, remote net.Addr) {
+	p.localAddr = local
+	p.remoteAddr = remote
+}
+
+func (p *PipeConn) LocalAddr() net.Addr {
+	return p.localAddr
+}
+
+func (p *PipeConn) RemoteAddr() net.Addr {
+	return p.remoteAddr
+}
+
+func (p *PipeConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (p *PipeConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (p *PipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,269 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/armon/go-socks5"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// DestinationMatcher matches destinations by host pattern and port. Hosts
+// may be CIDRs, IP addresses, host names with shell wildcards (*.example.com)
+// or domain suffixes (.example.com). Ports may be single ports or ranges
+// (8000-8100). Empty lists match anything.
+type DestinationMatcher struct {
+	Hosts []string
+	Ports []string
+}
+
+type PolicyRule struct {
+	DestinationMatcher `mapstructure:",squash"`
+	Action             string
+}
+
+// Policy is an ordered list of rules; the first matching rule wins and
+// Default is applied when none of them matches.
+type Policy struct {
+	Default string
+	Rules   []PolicyRule
+}
+
+func (p *Policy) Validate() error {
+	if err := validateAction(p.Default); err != nil {
+		return err
+	}
+
+	for i, rule := range p.Rules {
+		if err := validateAction(rule.Action); err != nil {
+			return fmt.Errorf("rule %d: %s", i+1, err.Error())
+		}
+
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %s", i+1, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Permits reports whether a connection to host:port is allowed. ip is the
+// resolved address of host, if known, and is matched against CIDR rules.
+func (p *Policy) Permits(host string, ip net.IP, port int) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, rule := range p.Rules {
+		if rule.Matches(host, ip, port) {
+			return strings.ToLower(rule.Action) == PolicyAllow
+		}
+	}
+
+	return strings.ToLower(p.Default) != PolicyDeny
+}
+
+// Decide is Permits for a host name that may not be resolved yet: it is not
+// decided when a rule matching addresses comes before any rule matching the
+// name, as only the address of host tells if that rule applies.
+func (p *Policy) Decide(host string, ip net.IP, port int) (permits bool, decided bool) {
+	if p == nil || ip != nil || net.ParseIP(host) != nil {
+		return p.Permits(host, ip, port), true
+	}
+
+	for _, rule := range p.Rules {
+		if rule.Matches(host, nil, port) {
+			return strings.ToLower(rule.Action) == PolicyAllow, true
+		}
+		if rule.checksAddresses() && rule.matchesPort(port) {
+			return false, false
+		}
+	}
+
+	return strings.ToLower(p.Default) != PolicyDeny, true
+}
+
+// ChecksAddresses reports whether some rule matches CIDRs or IP addresses,
+// so host names must be resolved to apply the policy.
+func (p *Policy) ChecksAddresses() bool {
+	if p == nil {
+		return false
+	}
+
+	for _, rule := range p.Rules {
+		if rule.checksAddresses() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allow implements socks5.RuleSet so a Policy can be plugged directly into
+// a SOCKS server. Only CONNECT requests are ever allowed.
+func (p *Policy) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		return ctx, false
+	}
+
+	dest := req.DestAddr
+	host := dest.FQDN
+	if host == "" {
+		host = dest.IP.String()
+	}
+
+	if !p.Permits(host, dest.IP, dest.Port) {
+		logger.Warningf("Connection to %s denied by policy", net.JoinHostPort(host, strconv.Itoa(dest.Port)))
+		return ctx, false
+	}
+
+	return ctx, true
+}
+
+func (m *DestinationMatcher) Validate() error {
+	for _, host := range m.Hosts {
+		if strings.Contains(host, "/") {
+			if _, _, err := net.ParseCIDR(host); err != nil {
+				return err
+			}
+		} else if _, err := path.Match(host, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q", host)
+		}
+	}
+
+	for _, ports := range m.Ports {
+		if _, _, err := parsePortRange(ports); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *DestinationMatcher) Matches(host string, ip net.IP, port int) bool {
+	return m.matchesHost(host, ip) && m.matchesPort(port)
+}
+
+func (m *DestinationMatcher) matchesHost(host string, ip net.IP) bool {
+	if len(m.Hosts) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip == nil {
+		ip = net.ParseIP(host)
+	}
+
+	for _, pattern := range m.Hosts {
+		if strings.Contains(pattern, "/") {
+			_, cidr, err := net.ParseCIDR(pattern)
+			if err == nil && ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if patternIP := net.ParseIP(pattern); patternIP != nil {
+			if ip != nil && patternIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		pattern = strings.ToLower(pattern)
+
+		if strings.HasPrefix(pattern, ".") {
+			if host == pattern[1:] || strings.HasSuffix(host, pattern) {
+				return true
+			}
+			continue
+		}
+
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *DestinationMatcher) checksAddresses() bool {
+	for _, host := range m.Hosts {
+		if strings.Contains(host, "/") || net.ParseIP(host) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *DestinationMatcher) matchesPort(port int) bool {
+	if len(m.Ports) == 0 {
+		return true
+	}
+
+	for _, ports := range m.Ports {
+		low, high, err := parsePortRange(ports)
+		if err == nil && port >= low && port <= high {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateAction(action string) error {
+	switch strings.ToLower(action) {
+	case "", PolicyAllow, PolicyDeny:
+		return nil
+	}
+	return fmt.Errorf("unknown policy action %q", action)
+}
+
+func parsePortRange(ports string) (int, int, error) {
+	if ports == "*" {
+		return 0, 65535, nil
+	}
+
+	bounds := strings.SplitN(ports, "-", 2)
+
+	low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", ports)
+	}
+
+	high := low
+	if len(bounds) == 2 {
+		high, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid port range %q", ports)
+		}
+	}
+
+	if low < 0 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q", ports)
+	}
+
+	return low, high, nil
+}
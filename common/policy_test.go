@@ -0,0 +1,195 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDestinationMatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher DestinationMatcher
+		host    string
+		ip      net.IP
+		port    int
+		want    bool
+	}{
+		{"empty matches anything", DestinationMatcher{}, "example.com", nil, 443, true},
+		{"cidr with ip host", DestinationMatcher{Hosts: []string{"10.0.0.0/8"}}, "10.1.2.3", nil, 22, true},
+		{"cidr outside", DestinationMatcher{Hosts: []string{"10.0.0.0/8"}}, "11.1.2.3", nil, 22, false},
+		{"cidr with resolved name", DestinationMatcher{Hosts: []string{"10.0.0.0/8"}}, "db.internal", net.ParseIP("10.0.0.5"), 5432, true},
+		{"cidr with unresolved name", DestinationMatcher{Hosts: []string{"10.0.0.0/8"}}, "db.internal", nil, 5432, false},
+		{"ipv6 cidr", DestinationMatcher{Hosts: []string{"fd00::/8"}}, "fd12::1", nil, 80, true},
+		{"ip address", DestinationMatcher{Hosts: []string{"192.168.1.1"}}, "192.168.1.1", nil, 80, true},
+		{"ip address of resolved name", DestinationMatcher{Hosts: []string{"192.168.1.1"}}, "router", net.ParseIP("192.168.1.1"), 80, true},
+		{"wildcard", DestinationMatcher{Hosts: []string{"*.example.com"}}, "www.example.com", nil, 80, true},
+		{"wildcard not the domain", DestinationMatcher{Hosts: []string{"*.example.com"}}, "example.com", nil, 80, false},
+		{"wildcard case and dot", DestinationMatcher{Hosts: []string{"*.Example.com"}}, "WWW.example.COM.", nil, 80, true},
+		{"suffix domain", DestinationMatcher{Hosts: []string{".example.com"}}, "example.com", nil, 80, true},
+		{"suffix subdomain", DestinationMatcher{Hosts: []string{".example.com"}}, "a.b.example.com", nil, 80, true},
+		{"suffix other domain", DestinationMatcher{Hosts: []string{".example.com"}}, "badexample.com", nil, 80, false},
+		{"exact name", DestinationMatcher{Hosts: []string{"localhost"}}, "localhost", nil, 80, true},
+		{"single port", DestinationMatcher{Ports: []string{"22"}}, "host", nil, 22, true},
+		{"other port", DestinationMatcher{Ports: []string{"22"}}, "host", nil, 23, false},
+		{"port range low", DestinationMatcher{Ports: []string{"8000-8100"}}, "host", nil, 8000, true},
+		{"port range high", DestinationMatcher{Ports: []string{"8000-8100"}}, "host", nil, 8100, true},
+		{"port range outside", DestinationMatcher{Ports: []string{"8000-8100"}}, "host", nil, 8101, false},
+		{"any port", DestinationMatcher{Ports: []string{"*"}}, "host", nil, 65535, true},
+		{"host and port", DestinationMatcher{Hosts: []string{".example.com"}, Ports: []string{"443"}}, "example.com", nil, 80, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.matcher.Matches(test.host, test.ip, test.port); got != test.want {
+				t.Errorf("Matches(%q, %v, %d) = %t, want %t", test.host, test.ip, test.port, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDestinationMatcherValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher DestinationMatcher
+		valid   bool
+	}{
+		{"valid", DestinationMatcher{Hosts: []string{"10.0.0.0/8", "*.example.com", ".example.org"}, Ports: []string{"22", "8000-8100", "*"}}, true},
+		{"invalid cidr", DestinationMatcher{Hosts: []string{"10.0.0.0/33"}}, false},
+		{"invalid pattern", DestinationMatcher{Hosts: []string{"[a-"}}, false},
+		{"invalid port", DestinationMatcher{Ports: []string{"ssh"}}, false},
+		{"reversed range", DestinationMatcher{Ports: []string{"100-10"}}, false},
+		{"port too high", DestinationMatcher{Ports: []string{"65536"}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.matcher.Validate(); (err == nil) != test.valid {
+				t.Errorf("Validate() = %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		valid  bool
+	}{
+		{"valid", Policy{Default: "Deny", Rules: []PolicyRule{{DestinationMatcher{Hosts: []string{"10.0.0.0/8"}}, PolicyAllow}}}, true},
+		{"unknown default", Policy{Default: "drop"}, false},
+		{"unknown action", Policy{Rules: []PolicyRule{{Action: "reject"}}}, false},
+		{"invalid destination", Policy{Rules: []PolicyRule{{DestinationMatcher{Ports: []string{"ssh"}}, PolicyDeny}}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.policy.Validate(); (err == nil) != test.valid {
+				t.Errorf("Validate() = %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestPolicyPermits(t *testing.T) {
+	policy := &Policy{
+		Default: PolicyDeny,
+		Rules: []PolicyRule{
+			{DestinationMatcher{Hosts: []string{"10.0.0.66"}}, PolicyDeny},
+			{DestinationMatcher{Hosts: []string{"10.0.0.0/8"}, Ports: []string{"22", "443"}}, PolicyAllow},
+			{DestinationMatcher{Hosts: []string{".example.com"}}, "Allow"},
+		},
+	}
+
+	tests := []struct {
+		host string
+		ip   net.IP
+		port int
+		want bool
+	}{
+		{"10.0.0.66", nil, 22, false},
+		{"10.0.0.1", nil, 22, true},
+		{"10.0.0.1", nil, 80, false},
+		{"db.internal", net.ParseIP("10.0.0.66"), 22, false},
+		{"www.example.com", nil, 8080, true},
+		{"example.net", nil, 443, false},
+	}
+
+	for _, test := range tests {
+		if got := policy.Permits(test.host, test.ip, test.port); got != test.want {
+			t.Errorf("Permits(%q, %v, %d) = %t, want %t", test.host, test.ip, test.port, got, test.want)
+		}
+	}
+
+	var none *Policy
+	if !none.Permits("anything", nil, 1) {
+		t.Error("a nil policy must permit everything")
+	}
+}
+
+func TestPolicyDecide(t *testing.T) {
+	policy := &Policy{
+		Default: PolicyDeny,
+		Rules: []PolicyRule{
+			{DestinationMatcher{Hosts: []string{"*.evil.com"}}, PolicyDeny},
+			{DestinationMatcher{Hosts: []string{"10.0.0.0/8"}, Ports: []string{"22"}}, PolicyAllow},
+			{DestinationMatcher{Hosts: []string{".example.com", "192.168.0.0/16"}}, PolicyAllow},
+		},
+	}
+
+	tests := []struct {
+		host    string
+		ip      net.IP
+		port    int
+		permits bool
+		decided bool
+	}{
+		{"www.evil.com", nil, 22, false, true},
+		{"db.internal", nil, 22, false, false},
+		{"db.internal", net.ParseIP("10.0.0.5"), 22, true, true},
+		{"db.internal", net.ParseIP("11.0.0.5"), 22, false, true},
+		{"10.0.0.5", nil, 22, true, true},
+		{"www.example.com", nil, 80, true, true},
+		{"db.internal", nil, 80, false, false},
+		{"192.168.1.1", nil, 80, true, true},
+	}
+
+	for _, test := range tests {
+		permits, decided := policy.Decide(test.host, test.ip, test.port)
+		if permits != test.permits || decided != test.decided {
+			t.Errorf("Decide(%q, %v, %d) = %t, %t, want %t, %t",
+				test.host, test.ip, test.port, permits, decided, test.permits, test.decided)
+		}
+	}
+
+	names := &Policy{Default: PolicyDeny, Rules: []PolicyRule{{DestinationMatcher{Hosts: []string{".example.com"}}, PolicyAllow}}}
+	if permits, decided := names.Decide("db.internal", nil, 22); permits || !decided {
+		t.Errorf("a policy of names must decide, got %t, %t", permits, decided)
+	}
+}
+
+func TestPolicyChecksAddresses(t *testing.T) {
+	names := &Policy{Rules: []PolicyRule{{DestinationMatcher{Hosts: []string{"*.example.com"}}, PolicyDeny}}}
+	if names.ChecksAddresses() {
+		t.Error("a policy of names must not need addresses")
+	}
+
+	cidrs := &Policy{Rules: []PolicyRule{{DestinationMatcher{Hosts: []string{"example.com", "10.0.0.0/8"}}, PolicyDeny}}}
+	if !cidrs.ChecksAddresses() {
+		t.Error("a policy with a CIDR must need addresses")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimits are in bytes per second, zero being unlimited. Upload is the
+// data read from local clients and Download the data read from destinations,
+// for the whole tunnel and for every stream.
+type RateLimits struct {
+	Upload         int64
+	Download       int64
+	StreamUpload   int64
+	StreamDownload int64
+}
+
+// TokenBucket limits the rate of a flow of bytes, allowing bursts of up to
+// one second of traffic. A nil bucket is unlimited.
+type TokenBucket struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	lock   *sync.Mutex
+}
+
+func NewTokenBucket(rate int64) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+		lock:   &sync.Mutex{},
+	}
+}
+
+func (b *TokenBucket) Rate() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.rate
+}
+
+func (b *TokenBucket) SetRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	if b.rate <= 0 {
+		b.tokens = float64(rate)
+	}
+	b.rate = rate
+}
+
+func (b *TokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+}
+
+// Wait takes n bytes from the bucket, sleeping while it is in debt.
+func (b *TokenBucket) Wait(n int) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return
+	}
+
+	b.refill()
+	b.tokens -= float64(n)
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	time.Sleep(wait)
+}
+
+// ParseRate parses a rate in bytes per second with an optional K, M or G
+// suffix (powers of 1024). Empty rates are unlimited.
+func ParseRate(rate string) (int64, error) {
+	rate = strings.TrimSpace(rate)
+	if rate == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch strings.ToUpper(rate[len(rate)-1:]) {
+	case "K":
+		multiplier = 1024
+	case "M":
+		multiplier = 1024 * 1024
+	case "G":
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		rate = rate[:len(rate)-1]
+	}
+
+	value, err := strconv.ParseFloat(rate, 64)
+	if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, errors.New("invalid rate " + rate)
+	}
+
+	// Would be truncated to 0, that is unlimited
+	bytes := value * float64(multiplier)
+	if bytes > 0 && bytes < 1 {
+		return 0, errors.New("rate " + rate + " below 1 byte per second")
+	}
+
+	return int64(bytes), nil
+}
+
+// FormatRate is the inverse of ParseRate, for humans.
+func FormatRate(rate int64) string {
+	switch {
+	case rate <= 0:
+		return "unlimited"
+	case rate >= 1024*1024*1024:
+		return fmt.Sprintf("%.1fG", float64(rate)/(1024*1024*1024))
+	case rate >= 1024*1024:
+		return fmt.Sprintf("%.1fM", float64(rate)/(1024*1024))
+	case rate >= 1024:
+		return fmt.Sprintf("%.1fK", float64(rate)/1024)
+	}
+	return strconv.FormatInt(rate, 10)
+}
@@ -0,0 +1,111 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		want int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"100", 100},
+		{" 512 ", 512},
+		{"1K", 1024},
+		{"0.001K", 1},
+		{"10k", 10 * 1024},
+		{"1.5M", 1536 * 1024},
+		{"2G", 2 * 1024 * 1024 * 1024},
+	}
+
+	for _, test := range tests {
+		got, err := ParseRate(test.rate)
+		if err != nil {
+			t.Errorf("ParseRate(%q) failed: %s", test.rate, err.Error())
+		} else if got != test.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", test.rate, got, test.want)
+		}
+	}
+}
+
+func TestParseRateErrors(t *testing.T) {
+	for _, rate := range []string{"fast", "K", "-1", "-2M", "1T", "1KB", "0.5", "0.0001K", "Inf", "NaN"} {
+		if _, err := ParseRate(rate); err == nil {
+			t.Errorf("ParseRate(%q) did not fail", rate)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name   string
+		bucket *TokenBucket
+		takes  []int
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"nil bucket is unlimited", nil, []int{1 << 30}, 0, 50 * time.Millisecond},
+		{"zero rate is unlimited", NewTokenBucket(0), []int{1 << 30}, 0, 50 * time.Millisecond},
+		{"burst of one second", NewTokenBucket(10000), []int{5000, 5000}, 0, 50 * time.Millisecond},
+		{"debt beyond the burst", NewTokenBucket(10000), []int{10000, 2000}, 150 * time.Millisecond, 400 * time.Millisecond},
+		{"single take beyond the burst", NewTokenBucket(10000), []int{13000}, 250 * time.Millisecond, 500 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		start := time.Now()
+		for _, n := range test.takes {
+			test.bucket.Wait(n)
+		}
+		took := time.Since(start)
+
+		if took < test.min || took > test.max {
+			t.Errorf("%s: took %s, want between %s and %s", test.name, took, test.min, test.max)
+		}
+	}
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	bucket := NewTokenBucket(0)
+
+	// A bucket that was unlimited starts full with the new rate
+	bucket.SetRate(10000)
+	if rate := bucket.Rate(); rate != 10000 {
+		t.Fatalf("Rate() = %d, want 10000", rate)
+	}
+
+	start := time.Now()
+	bucket.Wait(10000)
+	if took := time.Since(start); took > 50*time.Millisecond {
+		t.Errorf("first second of traffic took %s", took)
+	}
+
+	bucket.Wait(2000)
+	if took := time.Since(start); took < 150*time.Millisecond {
+		t.Errorf("traffic beyond the rate took only %s", took)
+	}
+
+	// Back to unlimited, there is no more wait
+	bucket.SetRate(0)
+	start = time.Now()
+	bucket.Wait(1 << 30)
+	if took := time.Since(start); took > 50*time.Millisecond {
+		t.Errorf("unlimited traffic took %s", took)
+	}
+}
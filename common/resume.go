@@ -0,0 +1,319 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/gob"
+	"github.com/rsrdesarrollo/SaSSHimi/metrics"
+	"io"
+	"sync"
+)
+
+// Messages kept until the peer acknowledges them, senders block beyond
+const resumeLogSize = 4096
+
+// Messages received before acknowledging them, when there is nothing to send
+const ackInterval = 64
+
+// resumeLog numbers the messages of a resumable channel and keeps them until
+// the peer acknowledges them, so the ones lost with a transport are sent
+// again through the next one.
+type resumeLog struct {
+	lock      *sync.Mutex
+	changed   *sync.Cond
+	messages  []*DataMessage
+	first     uint64 // sequence of messages[0]
+	closed    bool
+	transport uint64 // the current transport, the others stop writing
+	sent      uint64 // last sequence written by the current transport
+	ackWanted bool
+
+	deliverLock  *sync.Mutex
+	receivedLock *sync.Mutex
+	received     uint64 // last sequence delivered
+	unacked      int
+}
+
+func newResumeLog() *resumeLog {
+	l := &resumeLog{
+		lock:         &sync.Mutex{},
+		first:        1,
+		deliverLock:  &sync.Mutex{},
+		receivedLock: &sync.Mutex{},
+	}
+	l.changed = sync.NewCond(l.lock)
+
+	return l
+}
+
+// append numbers a message and keeps it, waiting while the log is full or
+// the current transport has not written all the messages before it, so the
+// scheduler still decides what goes next.
+func (l *resumeLog) append(msg *DataMessage) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for (len(l.messages) >= resumeLogSize || l.sent < l.first+uint64(len(l.messages))-1) && !l.closed {
+		l.changed.Wait()
+	}
+	if l.closed {
+		return
+	}
+
+	msg.Seq = l.first + uint64(len(l.messages))
+	l.messages = append(l.messages, msg)
+	l.changed.Broadcast()
+}
+
+// acknowledge forgets the messages up to seq, received by the peer.
+func (l *resumeLog) acknowledge(seq uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n := 0
+	for n < len(l.messages) && l.messages[n].Seq <= seq {
+		l.messages[n] = nil
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	l.messages = l.messages[n:]
+	l.first += uint64(n)
+	if l.sent < l.first-1 {
+		l.sent = l.first - 1
+	}
+	l.changed.Broadcast()
+}
+
+// next returns the message with sequence seq for a transport, waiting for
+// it, or wantsAck if an acknowledgement must be sent first. It returns nil
+// when the transport is replaced or the log closed and fully sent.
+func (l *resumeLog) next(transport uint64, seq uint64) (msg *DataMessage, wantsAck bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for l.transport == transport {
+		if l.ackWanted {
+			l.ackWanted = false
+			return nil, true
+		}
+
+		if seq < l.first {
+			seq = l.first
+		}
+		if i := seq - l.first; i < uint64(len(l.messages)) {
+			return l.messages[i], false
+		}
+
+		if l.closed {
+			return nil, false
+		}
+		l.changed.Wait()
+	}
+
+	return nil, false
+}
+
+// markSent records that a transport wrote the message with sequence seq.
+func (l *resumeLog) markSent(transport uint64, seq uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.transport == transport && seq > l.sent {
+		l.sent = seq
+		l.changed.Broadcast()
+	}
+}
+
+func (l *resumeLog) startTransport() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.transport++
+	l.sent = l.first - 1
+	l.changed.Broadcast()
+
+	return l.transport
+}
+
+// endTransport stops the writer of a transport, if still the current one.
+func (l *resumeLog) endTransport(transport uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.transport == transport {
+		l.transport++
+		l.changed.Broadcast()
+	}
+}
+
+func (l *resumeLog) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closed = true
+	l.changed.Broadcast()
+}
+
+// deliver sends a received message to in unless it was already delivered,
+// through a previous transport. The delivery lock is held while sending so
+// messages of two transports cannot be reordered, but not the received one,
+// so writers can still acknowledge.
+func (l *resumeLog) deliver(msg *DataMessage, in chan *DataMessage) bool {
+	l.deliverLock.Lock()
+	defer l.deliverLock.Unlock()
+
+	l.receivedLock.Lock()
+	delivered := msg.Seq <= l.received
+	l.receivedLock.Unlock()
+
+	if delivered {
+		return false
+	}
+
+	in <- msg
+
+	l.receivedLock.Lock()
+	defer l.receivedLock.Unlock()
+
+	l.received = msg.Seq
+
+	l.unacked++
+	if l.unacked >= ackInterval {
+		l.unacked = 0
+		l.lock.Lock()
+		l.ackWanted = true
+		l.changed.Broadcast()
+		l.lock.Unlock()
+	}
+
+	return true
+}
+
+// lastReceived returns the sequence to acknowledge.
+func (l *resumeLog) lastReceived() uint64 {
+	l.receivedLock.Lock()
+	defer l.receivedLock.Unlock()
+
+	l.unacked = 0
+	return l.received
+}
+
+// EnableResume makes the channel resumable: its messages are taken from the
+// scheduler as the transport writes them, numbered and kept until
+// acknowledged, and it is carried by RunTransport, through which
+// it survives the loss of a transport. Both ends must enable it.
+func (c *ChannelForwarder) EnableResume() {
+	c.resume = newResumeLog()
+
+	go func() {
+		for {
+			msg := c.OutQueue.Next()
+			if msg == nil {
+				break
+			}
+			c.resume.append(msg)
+		}
+		c.resume.close()
+	}()
+}
+
+// RunTransport carries a resumable channel through reader and writer until
+// one of them fails or the channel is closed. The channel stays open, to be
+// resumed with a new transport. The peer is told where to resume and the
+// messages it did not receive are sent again.
+func (c *ChannelForwarder) RunTransport(reader io.Reader, writer io.Writer) {
+	transport := c.resume.startTransport()
+	resumeAt := make(chan uint64, 1)
+	done := make(chan struct{})
+
+	go c.writeTransport(writer, transport, resumeAt, done)
+
+	decoder := gob.NewDecoder(reader)
+	resumed := false
+
+	for c.ChannelOpen {
+		var inMsg DataMessage
+		err := decoder.Decode(&inMsg)
+		if err != nil {
+			logger.Info("Transport read ended: ", err)
+			break
+		}
+		metrics.Messages.With(c.Name, "in", inMsg.Type()).Inc()
+
+		if inMsg.Ack != 0 {
+			c.resume.acknowledge(inMsg.Ack)
+		}
+
+		if inMsg.Resume {
+			if !resumed {
+				resumeAt <- inMsg.Ack + 1
+				resumed = true
+			}
+			continue
+		}
+
+		if inMsg.Seq != 0 {
+			c.resume.deliver(&inMsg, c.InChannel)
+		}
+	}
+
+	close(done)
+	c.resume.endTransport(transport)
+}
+
+func (c *ChannelForwarder) writeTransport(writer io.Writer, transport uint64, resumeAt chan uint64, done chan struct{}) {
+	defer c.resume.endTransport(transport)
+
+	encoder := gob.NewEncoder(writer)
+
+	err := encoder.Encode(&DataMessage{Resume: true, Ack: c.resume.lastReceived()})
+	if err != nil {
+		logger.Info("Transport write ended: ", err)
+		return
+	}
+
+	var seq uint64
+	select {
+	case seq = <-resumeAt:
+	case <-done:
+		return
+	}
+
+	for {
+		msg, wantsAck := c.resume.next(transport, seq)
+
+		var outMsg DataMessage
+		if msg != nil {
+			outMsg = *msg
+			seq = msg.Seq + 1
+		} else if !wantsAck {
+			return
+		}
+		outMsg.Ack = c.resume.lastReceived()
+
+		if err := encoder.Encode(&outMsg); err != nil {
+			logger.Info("Transport write ended: ", err)
+			return
+		}
+		metrics.Messages.With(c.Name, "out", outMsg.Type()).Inc()
+
+		if msg != nil {
+			c.resume.markSent(transport, msg.Seq)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newResumableChannel(name string) *ChannelForwarder {
+	c := &ChannelForwarder{
+		Name:        name,
+		InChannel:   make(chan *DataMessage, 16),
+		OutQueue:    NewScheduler(),
+		ChannelOpen: true,
+		Clients:     make(map[string]*Client),
+		ClientsLock: &sync.Mutex{},
+	}
+	c.EnableResume()
+	return c
+}
+
+// lossyWriter loses what is written once lose is set, as a transport dropped
+// with data in flight.
+type lossyWriter struct {
+	io.Writer
+	lose *atomic.Bool
+}
+
+func (w *lossyWriter) Write(p []byte) (int, error) {
+	if w.lose.Load() {
+		return len(p), nil
+	}
+	return w.Writer.Write(p)
+}
+
+// connect carries the two channels through a new transport, returning the
+// function that drops it.
+func connect(a *ChannelForwarder, b *ChannelForwarder, aWriter func(io.Writer) io.Writer) func() {
+	aConn, bConn := net.Pipe()
+
+	ended := &sync.WaitGroup{}
+	ended.Add(2)
+	go func() {
+		a.RunTransport(aConn, aWriter(aConn))
+		ended.Done()
+	}()
+	go func() {
+		b.RunTransport(bConn, bConn)
+		ended.Done()
+	}()
+
+	return func() {
+		aConn.Close()
+		bConn.Close()
+		ended.Wait()
+	}
+}
+
+func receive(t *testing.T, c *ChannelForwarder) *DataMessage {
+	select {
+	case msg := <-c.InChannel:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for a message")
+		return nil
+	}
+}
+
+func TestResumeAcrossDroppedTransport(t *testing.T) {
+	a, b := newResumableChannel("a"), newResumableChannel("b")
+	const total = 300
+
+	go sendStream(a.OutQueue, "stream", PriorityDefault, total)
+
+	lose := &atomic.Bool{}
+	drop := connect(a, b, func(w io.Writer) io.Writer { return &lossyWriter{Writer: w, lose: lose} })
+
+	next := 0
+	for ; next < 50; next++ {
+		if msg := receive(t, b); msg.Seq != uint64(next+1) {
+			t.Fatalf("message %d received with sequence %d", next, msg.Seq)
+		}
+	}
+
+	// Let the writer send into the void before dropping the transport
+	lose.Store(true)
+	time.Sleep(100 * time.Millisecond)
+	drop()
+
+	a.resume.lock.Lock()
+	sent := a.resume.sent
+	a.resume.lock.Unlock()
+	if sent <= uint64(next)+uint64(cap(b.InChannel))+1 {
+		t.Fatalf("only %d messages written by the dropped transport, none lost", sent)
+	}
+
+	drop = connect(a, b, func(w io.Writer) io.Writer { return w })
+	defer drop()
+
+	for ; next < total; next++ {
+		msg := receive(t, b)
+		if msg.Seq != uint64(next+1) || msg.Data[0] != byte(next) {
+			t.Fatalf("message %d received with sequence %d, lost or repeated", next, msg.Seq)
+		}
+	}
+
+	select {
+	case msg := <-b.InChannel:
+		t.Fatalf("unexpected message with sequence %d", msg.Seq)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// b acknowledges every ackInterval messages, so a forgets most of them
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.resume.lock.Lock()
+		kept := len(a.resume.messages)
+		a.resume.lock.Unlock()
+
+		if kept < ackInterval {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages still kept after they were acknowledged", kept)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResumeDeliverDoesNotBlockAcks(t *testing.T) {
+	l := newResumeLog()
+	in := make(chan *DataMessage)
+
+	delivered := make(chan bool)
+	go func() {
+		delivered <- l.deliver(&DataMessage{Seq: 1}, in)
+	}()
+
+	// While the delivery waits for the reader the writer still acknowledges
+	acked := make(chan uint64)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		acked <- l.lastReceived()
+	}()
+
+	select {
+	case seq := <-acked:
+		if seq != 0 {
+			t.Errorf("acknowledged %d before delivering it", seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lastReceived blocked by a pending delivery")
+	}
+
+	<-in
+	if !<-delivered {
+		t.Fatal("first delivery refused")
+	}
+	if l.deliver(&DataMessage{Seq: 1}, in) {
+		t.Error("a message received again through a new transport was delivered twice")
+	}
+	if seq := l.lastReceived(); seq != 1 {
+		t.Errorf("lastReceived = %d, want 1", seq)
+	}
+}
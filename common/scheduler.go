@@ -0,0 +1,213 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"errors"
+	"sync"
+)
+
+// Priority is the QoS class of a stream. The zero value is the default class
+// so it is not sent on the wire.
+type Priority uint8
+
+const (
+	PriorityDefault Priority = iota
+	PriorityInteractive
+	PriorityBulk
+)
+
+var priorityNames = map[Priority]string{
+	PriorityDefault:     "default",
+	PriorityInteractive: "interactive",
+	PriorityBulk:        "bulk",
+}
+
+func (p Priority) String() string {
+	return priorityNames[p]
+}
+
+func ParsePriority(name string) (Priority, error) {
+	for p, n := range priorityNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return PriorityDefault, errors.New("unknown priority class " + name)
+}
+
+// Share of the messages of every class, highest priority first, when all of
+// them have data to send. No class is ever starved.
+var priorityWeights = []struct {
+	priority Priority
+	weight   int
+}{
+	{PriorityInteractive, 16},
+	{PriorityDefault, 4},
+	{PriorityBulk, 1},
+}
+
+// Messages queued by stream before its client blocks
+const streamQueueSize = 10
+
+type streamQueue struct {
+	clientId string
+	messages []*DataMessage
+}
+
+// Scheduler queues the outgoing messages of a channel. Every stream has its
+// own queue, served in round robin with the other streams of its class, and
+// classes are chosen by weight, so a bulk transfer does not delay the
+// interactive streams. Messages not bound to a stream go first.
+type Scheduler struct {
+	control  []*DataMessage
+	classes  map[Priority][]*streamQueue
+	queues   map[string]*streamQueue
+	schedule []Priority
+	turn     int
+	closed   bool
+	lock     *sync.Mutex
+	cond     *sync.Cond
+}
+
+func NewScheduler() *Scheduler {
+	s := &Scheduler{
+		classes: make(map[Priority][]*streamQueue),
+		queues:  make(map[string]*streamQueue),
+		lock:    &sync.Mutex{},
+	}
+	s.cond = sync.NewCond(s.lock)
+
+	for _, w := range priorityWeights {
+		for i := 0; i < w.weight; i++ {
+			s.schedule = append(s.schedule, w.priority)
+		}
+	}
+
+	return s
+}
+
+// Send queues a message in the class given by its Priority, blocking while
+// the queue of its stream is full. Messages sent after Close are dropped.
+func (s *Scheduler) Send(msg *DataMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if msg.ClientId == "" {
+		if !s.closed {
+			s.control = append(s.control, msg)
+			s.cond.Broadcast()
+		}
+		return
+	}
+
+	for {
+		if s.closed {
+			return
+		}
+
+		q, prs := s.queues[msg.ClientId]
+		if !prs {
+			q = &streamQueue{clientId: msg.ClientId}
+			s.queues[msg.ClientId] = q
+			s.classes[msg.Priority] = append(s.classes[msg.Priority], q)
+		}
+
+		if len(q.messages) < streamQueueSize {
+			q.messages = append(q.messages, msg)
+			s.cond.Broadcast()
+			return
+		}
+
+		s.cond.Wait()
+	}
+}
+
+// Next returns the next message to write, blocking until there is one, or
+// nil once closed.
+func (s *Scheduler) Next() *DataMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		if s.closed {
+			return nil
+		}
+
+		if len(s.control) > 0 {
+			msg := s.control[0]
+			s.control = s.control[1:]
+			return msg
+		}
+
+		if len(s.queues) > 0 {
+			msg := s.pop(s.pick())
+			s.cond.Broadcast()
+			return msg
+		}
+
+		s.cond.Wait()
+	}
+}
+
+// pick returns the class of the current turn, or the highest one with data
+// if that class has nothing to send.
+func (s *Scheduler) pick() Priority {
+	priority := s.schedule[s.turn]
+	s.turn = (s.turn + 1) % len(s.schedule)
+
+	if len(s.classes[priority]) > 0 {
+		return priority
+	}
+
+	for _, w := range priorityWeights {
+		if len(s.classes[w.priority]) > 0 {
+			return w.priority
+		}
+	}
+
+	return priority
+}
+
+// pop takes a message from the first stream of a class and moves that
+// stream to the end of the round, or out of it once empty.
+func (s *Scheduler) pop(priority Priority) *DataMessage {
+	round := s.classes[priority]
+	q := round[0]
+
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+
+	if len(q.messages) > 0 {
+		s.classes[priority] = append(round[1:], q)
+	} else {
+		s.classes[priority] = round[1:]
+		delete(s.queues, q.clientId)
+	}
+
+	return msg
+}
+
+// Close drops the queued messages and releases everyone waiting.
+func (s *Scheduler) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	s.control = nil
+	s.classes = make(map[Priority][]*streamQueue)
+	s.queues = make(map[string]*streamQueue)
+	s.cond.Broadcast()
+}
@@ -0,0 +1,131 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func sendStream(s *Scheduler, clientId string, priority Priority, count int) {
+	for i := 0; i < count; i++ {
+		msg := NewMessage(clientId, []byte{byte(i)})
+		msg.Priority = priority
+		s.Send(msg)
+	}
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	s := NewScheduler()
+
+	// Enough queued in every class for a whole round of the schedule
+	for _, id := range []string{"i1", "i2", "i3"} {
+		sendStream(s, id, PriorityInteractive, streamQueueSize)
+	}
+	for _, id := range []string{"d1", "d2"} {
+		sendStream(s, id, PriorityDefault, streamQueueSize)
+	}
+	sendStream(s, "b1", PriorityBulk, streamQueueSize)
+
+	counts := make(map[Priority]int)
+	for i := 0; i < 21; i++ {
+		counts[s.Next().Priority]++
+	}
+
+	want := map[Priority]int{PriorityInteractive: 16, PriorityDefault: 4, PriorityBulk: 1}
+	for priority, count := range want {
+		if counts[priority] != count {
+			t.Errorf("%s messages in a round = %d, want %d", priority, counts[priority], count)
+		}
+	}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := NewScheduler()
+
+	sendStream(s, "bulk", PriorityBulk, 2)
+	sendStream(s, "a", PriorityInteractive, 2)
+	sendStream(s, "b", PriorityInteractive, 2)
+	s.Send(&DataMessage{KeepAlive: true})
+
+	want := []string{"", "a", "b", "a", "b", "bulk", "bulk"}
+	for i, id := range want {
+		if got := s.Next().ClientId; got != id {
+			t.Fatalf("message %d from %q, want %q", i, got, id)
+		}
+	}
+}
+
+func TestSchedulerStreamOrder(t *testing.T) {
+	s := NewScheduler()
+	sendStream(s, "a", PriorityDefault, streamQueueSize)
+
+	for i := 0; i < streamQueueSize; i++ {
+		if data := s.Next().Data; data[0] != byte(i) {
+			t.Fatalf("message %d of the stream read as %d", i, data[0])
+		}
+	}
+}
+
+func TestSchedulerBlocksFullStream(t *testing.T) {
+	s := NewScheduler()
+	sendStream(s, "a", PriorityDefault, streamQueueSize)
+
+	sent := make(chan struct{})
+	go func() {
+		sendStream(s, "a", PriorityDefault, 1)
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("Send did not block on a full stream queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Other streams are not blocked by it
+	sendStream(s, "b", PriorityDefault, 1)
+
+	s.Next()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Send still blocked after a message was taken")
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := NewScheduler()
+
+	next := make(chan *DataMessage)
+	go func() {
+		next <- s.Next()
+	}()
+
+	s.Close()
+	select {
+	case msg := <-next:
+		if msg != nil {
+			t.Errorf("Next after Close = %+v, want nil", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next still blocked after Close")
+	}
+
+	s.Send(NewMessage("a", nil))
+	if msg := s.Next(); msg != nil {
+		t.Errorf("message sent after Close was queued: %+v", msg)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// SocksReplyError is a SOCKS5 reply other than success.
+type SocksReplyError uint8
+
+var socksReplyMessages = map[SocksReplyError]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network is unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (e SocksReplyError) Error() string {
+	if msg, ok := socksReplyMessages[e]; ok {
+		return msg
+	}
+	return fmt.Sprintf("unknown SOCKS reply %d", uint8(e))
+}
+
+// SocksConnect runs the client side of a SOCKS5 CONNECT over conn,
+// authenticating with user if not nil, and returns the address bound by the
+// remote proxy.
+func SocksConnect(conn io.ReadWriter, addr string, user *url.Userinfo) (*net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.New("invalid port " + portStr)
+	}
+
+	methods := []byte{5, 1, 0}
+	if user != nil {
+		methods = []byte{5, 2, 0, 2}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return nil, err
+	}
+
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return nil, err
+	}
+
+	if method[0] != 5 || (method[1] != 0 && (method[1] != 2 || user == nil)) {
+		return nil, errors.New("remote proxy refused authentication method")
+	}
+
+	if method[1] == 2 {
+		if err := socksAuthenticate(conn, user); err != nil {
+			return nil, err
+		}
+	}
+
+	request := []byte{5, 1, 0}
+	ip := net.ParseIP(host)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, 1), ip4...)
+	} else if ip != nil {
+		request = append(append(request, 4), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("host name too long")
+		}
+		request = append(append(request, 3, byte(len(host))), host...)
+	}
+
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	var boundIP []byte
+	switch header[3] {
+	case 1:
+		boundIP = make([]byte, 4)
+	case 4:
+		boundIP = make([]byte, 16)
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		// Bound host names are not meaningful for us, discard them
+		boundIP = make([]byte, length[0])
+	default:
+		return nil, SocksReplyError(8)
+	}
+
+	boundPort := make([]byte, 2)
+	if _, err := io.ReadFull(conn, boundIP); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, boundPort); err != nil {
+		return nil, err
+	}
+
+	if header[1] != 0 {
+		return nil, SocksReplyError(header[1])
+	}
+
+	bound := &net.TCPAddr{IP: net.IPv4zero, Port: int(binary.BigEndian.Uint16(boundPort))}
+	if header[3] != 3 {
+		bound.IP = boundIP
+	}
+
+	return bound, nil
+}
+
+// socksAuthenticate runs the username and password authentication of RFC 1929.
+func socksAuthenticate(conn io.ReadWriter, user *url.Userinfo) error {
+	password, _ := user.Password()
+	if len(user.Username()) > 255 || len(password) > 255 {
+		return errors.New("proxy credentials too long")
+	}
+
+	request := append([]byte{1, byte(len(user.Username()))}, user.Username()...)
+	request = append(append(request, byte(len(password))), password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return err
+	}
+
+	if status[1] != 0 {
+		return errors.New("proxy authentication failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import "time"
+
+const (
+	ExpiredIdle     = "idle timeout"
+	ExpiredLifetime = "max lifetime"
+)
+
+// StreamLimits bound the streams of a channel, zero being unlimited.
+type StreamLimits struct {
+	MaxStreams  int
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+}
+
+// Expired returns why a client must be closed under limits, or an empty
+// string if it can go on.
+func (c *Client) Expired(limits StreamLimits) string {
+	if limits.MaxLifetime > 0 && c.Age() > limits.MaxLifetime {
+		return ExpiredLifetime
+	}
+	if limits.IdleTimeout > 0 && !c.Exec && c.Idle() > limits.IdleTimeout {
+		return ExpiredIdle
+	}
+	return ""
+}
+
+// ExpiredClients returns the clients to close under limits, with the reason.
+func (c *ChannelForwarder) ExpiredClients(limits StreamLimits) map[*Client]string {
+	expired := make(map[*Client]string)
+
+	if limits.IdleTimeout <= 0 && limits.MaxLifetime <= 0 {
+		return expired
+	}
+
+	c.ClientsLock.Lock()
+	defer c.ClientsLock.Unlock()
+
+	for _, client := range c.Clients {
+		if client.IsDead() {
+			continue
+		}
+		if reason := client.Expired(limits); reason != "" {
+			expired[client] = reason
+		}
+	}
+
+	return expired
+}
@@ -0,0 +1,257 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Upstream proxy URL meaning the one in the environment of the agent
+const UpstreamFromEnvironment = "env"
+
+// Time given to the upstream proxy to accept a connection
+const upstreamHandshakeTimeout = 30 * time.Second
+
+// UpstreamProxy is the proxy the agent dials the destinations through, for
+// networks without direct egress.
+type UpstreamProxy struct {
+	// http://[user:password@]host:port for HTTP CONNECT, or socks5:// and
+	// socks5h:// for SOCKS5 with names resolved by the agent or the proxy
+	URL string
+	// Destinations dialed directly, as the hosts of the policy
+	NoProxy []string
+}
+
+func (u *UpstreamProxy) Validate() error {
+	if u.URL == UpstreamFromEnvironment {
+		return nil
+	}
+
+	if _, err := u.proxyURL(); err != nil {
+		return err
+	}
+
+	matcher := DestinationMatcher{Hosts: u.NoProxy}
+	return matcher.Validate()
+}
+
+// proxyURL parses the URL, http being the default scheme.
+func (u *UpstreamProxy) proxyURL() (*url.URL, error) {
+	raw := u.URL
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.New("invalid upstream proxy: " + err.Error())
+	}
+
+	defaultPort := map[string]string{"http": "80", "socks5": "1080", "socks5h": "1080"}
+	port, prs := defaultPort[proxyURL.Scheme]
+	if !prs {
+		return nil, errors.New("unsupported upstream proxy scheme " + proxyURL.Scheme)
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, errors.New("upstream proxy without host")
+	}
+	if proxyURL.Port() == "" {
+		proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	return proxyURL, nil
+}
+
+// String is the URL without password, for logs.
+func (u *UpstreamProxy) String() string {
+	if proxyURL, err := u.proxyURL(); err == nil {
+		return proxyURL.Redacted()
+	}
+	return u.URL
+}
+
+// UpstreamFromEnv returns the proxy given by HTTPS_PROXY or ALL_PROXY, and
+// NO_PROXY, in the environment read by getenv, or nil if there is none.
+func UpstreamFromEnv(getenv func(string) string) *UpstreamProxy {
+	lookup := func(names ...string) string {
+		for _, name := range names {
+			if value := getenv(name); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	proxy := lookup("HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy")
+	if proxy == "" {
+		return nil
+	}
+
+	upstream := &UpstreamProxy{URL: proxy}
+
+	// Names also match their subdomains, as for curl
+	for _, entry := range strings.Split(lookup("NO_PROXY", "no_proxy"), ",") {
+		entry = strings.TrimSpace(entry)
+		if host, _, err := net.SplitHostPort(entry); err == nil {
+			entry = host
+		}
+
+		switch {
+		case entry == "":
+		case entry == "*", strings.HasPrefix(entry, "."), strings.Contains(entry, "/"), net.ParseIP(entry) != nil:
+			upstream.NoProxy = append(upstream.NoProxy, entry)
+		default:
+			upstream.NoProxy = append(upstream.NoProxy, "."+strings.TrimPrefix(entry, "*."))
+		}
+	}
+
+	return upstream
+}
+
+// ProxyFor returns the proxy for a destination host, or nil if it is dialed
+// directly.
+func (u *UpstreamProxy) ProxyFor(host string) *url.URL {
+	if u == nil {
+		return nil
+	}
+
+	matcher := DestinationMatcher{Hosts: u.NoProxy}
+	if len(u.NoProxy) > 0 && matcher.matchesHost(host, nil) {
+		return nil
+	}
+
+	proxyURL, err := u.proxyURL()
+	if err != nil {
+		return nil
+	}
+
+	return proxyURL
+}
+
+// ResolvesNames tells if the proxy for a destination host resolves its name,
+// so the agent must not.
+func (u *UpstreamProxy) ResolvesNames(host string) bool {
+	proxyURL := u.ProxyFor(host)
+	return proxyURL != nil && proxyURL.Scheme != "socks5"
+}
+
+// Dial connects to addr through the proxy, or directly if not proxied.
+func (u *UpstreamProxy) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyURL := u.ProxyFor(host)
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, errors.New("upstream proxy " + proxyURL.Host + ": " + err.Error())
+	}
+
+	deadline := time.Now().Add(upstreamHandshakeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	if proxyURL.Scheme == "http" {
+		conn, err = HttpConnect(conn, addr, proxyURL.User)
+	} else {
+		_, err = SocksConnect(conn, addr, proxyURL.User)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("upstream proxy " + proxyURL.Host + ": " + err.Error())
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// HttpConnect asks an HTTP proxy to open a tunnel to addr over conn.
+func HttpConnect(conn net.Conn, addr string, user *url.Userinfo) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+
+	// Refused by the rules of the proxy, as agents serving HTTP do by policy
+	if resp.StatusCode == http.StatusForbidden {
+		return conn, SocksReplyError(2)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, errors.New("CONNECT refused: " + resp.Status)
+	}
+
+	// Servers speaking first may have sent data along with the response
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection with data already read into reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(closeWriter); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics keeps a small set of counters and gauges and exposes them
+// in the Prometheus text format. It has no dependencies so it can be linked
+// into the agent at no cost.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	kindCounter = "counter"
+	kindGauge   = "gauge"
+)
+
+// Value is a single sample of a metric family.
+type Value struct {
+	bits uint64
+}
+
+func (v *Value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+func (v *Value) Dec() {
+	v.Add(-1)
+}
+
+func (v *Value) Set(value float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(value))
+}
+
+func (v *Value) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Family is a metric with a fixed set of label names and one Value for
+// every combination of label values seen so far.
+type Family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	values  map[string]*Value
+	lock    *sync.Mutex
+	collect func(f *Family)
+}
+
+var registry []*Family
+var registryLock = &sync.Mutex{}
+
+func newFamily(name string, help string, kind string, labels []string) *Family {
+	f := &Family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*Value),
+		lock:   &sync.Mutex{},
+	}
+
+	registryLock.Lock()
+	registry = append(registry, f)
+	registryLock.Unlock()
+
+	return f
+}
+
+func NewCounter(name string, help string, labels ...string) *Family {
+	return newFamily(name, help, kindCounter, labels)
+}
+
+func NewGauge(name string, help string, labels ...string) *Family {
+	return newFamily(name, help, kindGauge, labels)
+}
+
+// With returns the Value for the given label values, in the order of the
+// label names of the family.
+func (f *Family) With(labelValues ...string) *Value {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	v, prs := f.values[key]
+	if !prs {
+		v = &Value{}
+		f.values[key] = v
+	}
+
+	return v
+}
+
+// Reset drops all the values of the family.
+func (f *Family) Reset() {
+	f.lock.Lock()
+	f.values = make(map[string]*Value)
+	f.lock.Unlock()
+}
+
+// OnCollect sets a function called before every scrape, to refresh gauges
+// that are cheaper to compute on demand than to keep updated.
+func (f *Family) OnCollect(collect func(f *Family)) {
+	f.lock.Lock()
+	f.collect = collect
+	f.lock.Unlock()
+}
+
+func (f *Family) write(w io.Writer) {
+	f.lock.Lock()
+	collect := f.collect
+	f.lock.Unlock()
+
+	if collect != nil {
+		collect(f)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, f.formatLabels(key), strconv.FormatFloat(f.values[key].Get(), 'g', -1, 64))
+	}
+}
+
+func (f *Family) formatLabels(key string) string {
+	if len(f.labels) == 0 {
+		return ""
+	}
+
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(f.labels))
+	for i, label := range f.labels {
+		pairs[i] = label + "=" + strconv.Quote(values[i])
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteText writes all the registered metrics in the Prometheus text format.
+func WriteText(w io.Writer) {
+	registryLock.Lock()
+	families := append([]*Family{}, registry...)
+	registryLock.Unlock()
+
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteText(w)
+	})
+}
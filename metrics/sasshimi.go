@@ -0,0 +1,26 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+var (
+	ActiveStreams = NewGauge("sasshimi_active_streams", "Streams currently open through a tunnel.", "pool", "tunnel")
+	TunnelUp      = NewGauge("sasshimi_tunnel_up", "Whether the SSH channel of a tunnel is open.", "pool", "tunnel")
+	KeepAliveRTT  = NewGauge("sasshimi_keepalive_rtt_seconds", "Last keep alive round trip time of a tunnel.", "tunnel")
+	Reconnects    = NewCounter("sasshimi_reconnects_total", "Tunnels replaced by a new connection.", "tunnel")
+	Messages      = NewCounter("sasshimi_messages_total", "Messages through the tunnel channel, by direction and type.", "tunnel", "direction", "type")
+	ClientBytes   = NewCounter("sasshimi_client_bytes_total", "Bytes read from clients and sent to the tunnel, or received from the tunnel and written to clients.", "direction")
+	Accepted      = NewCounter("sasshimi_accepted_connections_total", "Connections accepted by the local listeners.", "protocol")
+	DialFailures  = NewCounter("sasshimi_dial_failures_total", "Connections that could not be established, by reason.", "reason")
+)
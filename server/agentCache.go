@@ -0,0 +1,99 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+// Per-user directory for cached agents and cleanup manifests, inside the
+// remote directory
+const remoteUserDirectory = ".sasshimi-$(id -u)"
+
+func (t *tunnel) useAgentCache() bool {
+	return t.viper.GetBool("Upload.Cache")
+}
+
+// prepareUserDirectory creates the user directory in a remote directory. It
+// is only accessible by the user, as it may be in a shared directory.
+func (t *tunnel) prepareUserDirectory(dir string) (string, error) {
+	script := fmt.Sprintf(`c=%s/%s
+[ -d "$c" ] || mkdir -m 700 "$c" || exit 1
+[ -O "$c" ] && [ ! -L "$c" ] || { echo "$c is not owned by the user" >&2; exit 1; }
+echo "$c"`, shellQuote(dir), remoteUserDirectory)
+
+	output, err := runRemote(t.sshClient, nil, script)
+	if err != nil {
+		return "", err
+	}
+
+	userDir := strings.TrimSpace(string(output))
+	if userDir == "" {
+		return "", errors.New("empty directory")
+	}
+
+	return userDir, nil
+}
+
+// errNoChecksumTool is returned when the remote host has none of the tools
+// to compute a checksum. The file is never run to check itself.
+var errNoChecksumTool = errors.New("no sha256sum, shasum or openssl")
+
+// remoteChecksum returns the SHA-256 of a remote file with the first tool
+// available.
+func (t *tunnel) remoteChecksum(remotePath string) (string, error) {
+	script := fmt.Sprintf(`f=%s
+[ -f "$f" ] || { echo "$f not found" >&2; exit 1; }
+if command -v sha256sum >/dev/null 2>&1; then sha256sum "$f"
+elif command -v shasum >/dev/null 2>&1; then shasum -a 256 "$f"
+elif command -v openssl >/dev/null 2>&1; then openssl dgst -sha256 -r "$f"
+else exit 3; fi`, shellQuote(remotePath))
+
+	output, err := runRemote(t.sshClient, nil, script)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitStatus() == 3 {
+		return "", errNoChecksumTool
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 || len(fields[0]) != 64 {
+		return "", errors.New("unexpected checksum output " + strings.TrimSpace(string(output)))
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
+// verifyRemote checks that a remote file has the given SHA-256.
+func (t *tunnel) verifyRemote(remotePath string, sum string) error {
+	remoteSum, err := t.remoteChecksum(remotePath)
+	if err == errNoChecksumTool {
+		return err
+	}
+	if err != nil {
+		return errors.New("unable to verify " + remotePath + ": " + err.Error())
+	}
+
+	if remoteSum != sum {
+		return errors.New("checksum mismatch for " + remotePath + ", got " + remoteSum)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/op/go-logging"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"strings"
+	"sync"
+)
+
+// logEnv returns the variables of utils.LogEnv as assignments for the remote
+// shell, as the levels may name any module.
+func logEnv() string {
+	var assignments []string
+	for _, variable := range utils.LogEnv() {
+		name, value, _ := strings.Cut(variable, "=")
+		assignments = append(assignments, name+"="+shellQuote(value))
+	}
+	return strings.Join(assignments, " ")
+}
+
+// agentLogWriter relays the stderr of a remote agent to the local log. Lines
+// in JSON, as logged by agents started with utils.LogEnv, keep their level
+// and fields; anything else is logged as is.
+type agentLogWriter struct {
+	tunnel string
+	buffer []byte
+	lock   *sync.Mutex
+}
+
+func newAgentLogWriter(tunnel string) *agentLogWriter {
+	return &agentLogWriter{tunnel: tunnel, lock: &sync.Mutex{}}
+}
+
+func (w *agentLogWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.buffer = append(w.buffer, p...)
+
+	for {
+		idx := bytes.IndexByte(w.buffer, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(w.buffer[:idx]), "\r")
+		w.buffer = w.buffer[idx+1:]
+
+		if line != "" {
+			w.relay(line)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *agentLogWriter) relay(line string) {
+	var entry map[string]interface{}
+
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		utils.WithFields(utils.NewLogger("agent"), utils.Fields{"tunnel": w.tunnel}).Log(logging.NOTICE, line)
+		return
+	}
+
+	module, _ := entry["module"].(string)
+	if module == "" {
+		module = "agent"
+	}
+
+	levelName, _ := entry["level"].(string)
+	level, err := logging.LogLevel(levelName)
+	if err != nil {
+		level = logging.NOTICE
+	}
+
+	message, _ := entry["message"].(string)
+
+	fields := utils.Fields{"tunnel": w.tunnel}
+	for key, value := range entry {
+		switch key {
+		case "time", "level", "module", "message":
+		default:
+			fields[key] = value
+		}
+	}
+
+	utils.WithFields(utils.NewLogger(module), fields).Log(level, message)
+}
@@ -0,0 +1,43 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/op/go-logging"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestLogEnvQuotesModules(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to run the assignments")
+	}
+
+	module := "x'; exit 3; '"
+	utils.SetLogLevel(logging.DEBUG, module)
+	defer utils.SetLogLevel(utils.GetLogLevel(""), "")
+
+	output, err := exec.Command(sh, "-c", logEnv()+` sh -c 'printf %s "$LOGLEVEL"'`).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(output), module+"=debug") {
+		t.Errorf("LOGLEVEL = %q, want it to contain %q", output, module+"=debug")
+	}
+}
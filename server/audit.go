@@ -0,0 +1,247 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mitchellh/go-homedir"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditClientClosed = "client closed"
+	auditRemoteClosed = "remote closed"
+	auditRemoteError  = "remote error"
+	auditKilled       = "killed"
+	auditTunnelClosed = "tunnel closed"
+	auditDenied       = "denied by policy"
+	auditRejected     = "rejected by route"
+	auditNoTunnel     = "no tunnel alive"
+)
+
+// auditRecord is written once per stream, when it ends. Connections refused
+// before opening a stream are recorded too, with the same start and end.
+type auditRecord struct {
+	Client        string    `json:"client"`
+	User          string    `json:"user,omitempty"`
+	Destination   string    `json:"destination"`
+	Tunnel        string    `json:"tunnel,omitempty"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	BytesSent     uint64    `json:"bytes_sent"`
+	BytesReceived uint64    `json:"bytes_received"`
+	Reason        string    `json:"reason"`
+
+	// Bytes of the handshake with the remote proxy, not sent by the client
+	connected      bool
+	handshakeSent  uint64
+	handshakeRecvd uint64
+}
+
+// auditLog writes audit records as JSON lines to a file or to syslog.
+type auditLog struct {
+	writer io.WriteCloser
+	lock   *sync.Mutex
+}
+
+// The audit log of the server, nil if disabled
+var audit *auditLog
+
+// openAuditLog opens a file, or syslog if target is "syslog" (the local
+// daemon) or "syslog://host:port" (a remote one over UDP).
+func openAuditLog(target string) (*auditLog, error) {
+	var writer io.WriteCloser
+	var err error
+
+	if target == "syslog" || strings.HasPrefix(target, "syslog://") {
+		writer, err = openSyslog(strings.TrimPrefix(target[len("syslog"):], "://"))
+	} else {
+		var path string
+		path, err = homedir.Expand(target)
+		if err == nil {
+			writer, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		}
+	}
+
+	if err != nil {
+		return nil, errors.New("unable to open audit log: " + err.Error())
+	}
+
+	return &auditLog{writer: writer, lock: &sync.Mutex{}}, nil
+}
+
+// openAudit enables the audit log given by the AuditLog key, if any.
+func openAudit(config *viper.Viper) {
+	target := config.GetString("AuditLog")
+	if target == "" {
+		return
+	}
+
+	var err error
+	if audit, err = openAuditLog(target); err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	logger.Notice("Audit log at", target)
+}
+
+func (a *auditLog) write(record *auditRecord) {
+	if a == nil {
+		return
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		logger.Error("Unable to encode audit record: " + err.Error())
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, err := a.writer.Write(append(data, '\n')); err != nil {
+		logger.Error("Unable to write audit record: " + err.Error())
+	}
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.writer.Close()
+}
+
+// auditRefused records a connection that never became a stream.
+func auditRefused(ctx context.Context, destination string, tunnel string, reason string) {
+	if audit == nil {
+		return
+	}
+
+	clientAddr, _ := ctx.Value(clientKey{}).(string)
+	user, _ := ctx.Value(userKey{}).(string)
+	now := time.Now()
+
+	audit.write(&auditRecord{
+		Client:      clientAddr,
+		User:        user,
+		Destination: destination,
+		Tunnel:      tunnel,
+		Start:       now,
+		End:         now,
+		Reason:      reason,
+	})
+}
+
+// auditTrail keeps the records of the open streams of a tunnel.
+type auditTrail struct {
+	records map[string]*auditRecord
+	lock    *sync.Mutex
+}
+
+func newAuditTrail() *auditTrail {
+	return &auditTrail{
+		records: make(map[string]*auditRecord),
+		lock:    &sync.Mutex{},
+	}
+}
+
+func (a *auditTrail) start(ctx context.Context, tunnel string, client *common.Client) {
+	clientAddr, _ := ctx.Value(clientKey{}).(string)
+	user, _ := ctx.Value(userKey{}).(string)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.records[client.Id] = &auditRecord{
+		Client:      clientAddr,
+		User:        user,
+		Destination: client.Destination,
+		Tunnel:      tunnel,
+		Start:       time.Now(),
+	}
+}
+
+// connected marks the end of the handshake of a stream, so its bytes are
+// not accounted to the client.
+func (a *auditTrail) connected(client *common.Client) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if record, prs := a.records[client.Id]; prs {
+		record.connected = true
+		record.handshakeSent = client.BytesSent()
+		record.handshakeRecvd = client.BytesReceived()
+	}
+}
+
+// reason sets why a stream is going to end, unless already known.
+func (a *auditTrail) reason(clientId string, reason string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if record, prs := a.records[clientId]; prs && record.Reason == "" {
+		record.Reason = reason
+	}
+}
+
+// end writes the record of a stream, with reason unless one was set before.
+func (a *auditTrail) end(client *common.Client, reason string) {
+	a.lock.Lock()
+	record, prs := a.records[client.Id]
+	delete(a.records, client.Id)
+	a.lock.Unlock()
+
+	if !prs {
+		return
+	}
+
+	record.End = time.Now()
+	if record.connected {
+		record.BytesSent = client.BytesSent() - record.handshakeSent
+		record.BytesReceived = client.BytesReceived() - record.handshakeRecvd
+	}
+	if record.Reason == "" {
+		record.Reason = reason
+	}
+
+	audit.write(record)
+}
+
+// auditRemaining writes the records of the streams still open, as the tunnel
+// is gone.
+func (t *tunnel) auditRemaining() {
+	t.ClientsLock.Lock()
+	clients := make([]*common.Client, 0, len(t.Clients))
+	for _, client := range t.Clients {
+		clients = append(clients, client)
+	}
+	t.ClientsLock.Unlock()
+
+	for _, client := range clients {
+		t.audits.end(client, auditTunnelClosed)
+	}
+}
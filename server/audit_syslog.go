@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package server
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func openSyslog(address string) (io.WriteCloser, error) {
+	if address == "" {
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "SaSSHimi")
+	}
+	return syslog.Dial("udp", address, syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "SaSSHimi")
+}
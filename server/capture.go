@@ -0,0 +1,62 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"github.com/mitchellh/go-homedir"
+	"github.com/rsrdesarrollo/SaSSHimi/capture"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/spf13/viper"
+)
+
+// The capture of the stream payloads, nil if disabled
+var captureFile *capture.File
+
+// openCapture starts the capture given by the Capture key, if any.
+func openCapture(config *viper.Viper) {
+	target := config.GetString("Capture")
+	if target == "" {
+		return
+	}
+
+	path, err := homedir.Expand(target)
+	if err != nil {
+		logger.Fatal("Invalid capture path: " + err.Error())
+	}
+
+	if captureFile, err = capture.Create(path); err != nil {
+		logger.Fatal("Unable to create capture file: " + err.Error())
+	}
+
+	logger.Notice("Capturing streams to", path)
+}
+
+func closeCapture() {
+	if captureFile != nil {
+		captureFile.Close()
+	}
+}
+
+// captureStream records the payload of a stream, once connected, as a TCP
+// flow from the local client to its destination.
+func captureStream(ctx context.Context, client *common.Client) {
+	if captureFile == nil {
+		return
+	}
+
+	clientAddr, _ := ctx.Value(clientKey{}).(string)
+	client.SetRecorder(captureFile.NewFlow(clientAddr, client.Destination))
+}
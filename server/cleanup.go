@@ -0,0 +1,156 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+// cleanupScript kills the orphaned agents of the user, the ones without an
+// sshd process above them, or all of them, and removes the files of the
+// agents no longer running: the ones listed in their manifests and, for
+// agents without one, the binaries and sockets matching their names.
+// Persistent agents are left running unless all is set, as they wait for
+// their server and exit by themselves. Every action is reported in a line.
+// Directories and files are kept in lists of lines, as they may have spaces.
+const cleanupScript = `uid=$(id -u)
+nl='
+'
+running= running_names= killed= manifested= sockets= unknown=
+
+attached() {
+	p=$1
+	while [ -n "$p" ] && [ "$p" -gt 1 ]; do
+		case "$(ps -o comm= -p "$p" 2>/dev/null)" in *sshd*) return 0 ;; esac
+		p=$(ps -o ppid= -p "$p" 2>/dev/null | tr -d ' ')
+	done
+	return 1
+}
+
+while read -r pid ppid args; do
+	case "$args" in *" agent "*|*" agent") ;; *) continue ;; esac
+	cmd=${args%%" agent"*}
+	rest=${args#"$cmd agent"}
+	case "${cmd##*/}" in .daemon_*|.upload_*|agent-*|sasshimi|SaSSHimi*) ;; *) continue ;; esac
+	case " $rest " in *" --daemon "*) persistent=1 ;; *) persistent= ;; esac
+	if [ "$all" = 1 ] || { [ -z "$persistent" ] && ! attached "$ppid"; }; then
+		kill "$pid" 2>/dev/null && echo "killed agent $pid $cmd" && killed="$killed $pid"
+	else
+		echo "running agent $pid $cmd"
+		running="$running $pid"
+		running_names="$running_names ${cmd##*/}"
+	fi
+done <<EOF
+$(ps -u "$uid" -o pid= -o ppid= -o args= 2>/dev/null)
+EOF
+
+if [ -n "$killed" ]; then
+	sleep 2
+	for pid in $killed; do kill -9 "$pid" 2>/dev/null && echo "forced agent $pid"; done
+fi
+
+in_list() { case " $2 " in *" $1 "*) return 0 ;; esac; return 1; }
+in_lines() { case "$nl$2$nl" in *"$nl$1$nl"*) return 0 ;; esac; return 1; }
+
+remove() { [ -e "$1" ] || return 0; rm -f "$1" && echo "removed $1"; }
+
+while IFS= read -r d; do
+	[ -n "$d" ] || continue
+	for m in "$d/.sasshimi-$uid"/*.manifest; do
+		[ -f "$m" ] || continue
+		pid=$(sed -n 's/^pid //p' "$m")
+		if [ -n "$pid" ] && in_list "$pid" "$running"; then
+			manifested="$manifested $pid"
+			sockets="$sockets$nl$(sed -n 's/^socket //p' "$m")"
+			continue
+		fi
+		sed -n 's/^socket //p;s/^binary //p' "$m" | while IFS= read -r f; do remove "$f"; done
+		remove "$m"
+	done
+done <<EOF
+$dirs
+EOF
+
+for pid in $running; do in_list "$pid" "$manifested" || unknown=1; done
+
+printf '%s\n' "$dirs" | while IFS= read -r d; do
+	[ -n "$d" ] || continue
+	for f in "$d"/.daemon_* "$d/.sasshimi-$uid"/.upload_*; do
+		[ -f "$f" ] && ! in_list "${f##*/}" "$running_names" && remove "$f"
+	done
+	if [ "$cache" = 1 ]; then
+		for f in "$d/.sasshimi-$uid"/agent-*; do
+			[ -f "$f" ] && ! in_list "${f##*/}" "$running_names" && remove "$f"
+		done
+		rmdir "$d/.sasshimi-$uid" 2>/dev/null && echo "removed $d/.sasshimi-$uid"
+	fi
+	# The sockets of agents without manifest are unknown, keep them while any runs
+	if [ -z "$unknown" ]; then
+		for f in "$d"/daemon_*; do [ -S "$f" ] && ! in_lines "$f" "$sockets" && remove "$f"; done
+	fi
+done
+
+[ -z "$unknown" ] || echo "kept the sockets in use, some running agents have no manifest"
+true`
+
+// Cleanup removes what the agents left on the host of config: it kills the
+// orphaned agents, or every agent of the user if all is set, and removes the
+// files of the agents not running, and the cache if cache is set. It returns
+// a line per action.
+func Cleanup(config *viper.Viper, all bool, cache bool) ([]string, error) {
+	t := &tunnel{viper: config}
+	t.Name = t.getRemoteHost()
+
+	if err := t.dial(); err != nil {
+		return nil, err
+	}
+	defer t.sshClient.Close()
+
+	// Older versions run the agent from the login directory
+	dirs := append([]string{"$HOME"}, t.getRemoteDirectories()...)
+
+	script := &strings.Builder{}
+	fmt.Fprintf(script, "all=%d cache=%d\n", boolToInt(all), boolToInt(cache))
+	script.WriteString("dirs=$(for d in")
+	for _, dir := range dirs {
+		script.WriteString(" " + shellQuoteVariables(dir))
+	}
+	script.WriteString(`; do [ -n "$d" ] && [ -d "$d" ] && echo "$d"; done | sort -u)` + "\n")
+	script.WriteString(cleanupScript)
+
+	output, err := runRemote(t.sshClient, nil, script.String())
+	if err != nil {
+		return nil, errors.New("cleanup failed: " + err.Error())
+	}
+
+	var actions []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line != "" {
+			actions = append(actions, line)
+		}
+	}
+
+	return actions, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/spf13/viper"
+	"net"
+	"sync"
+)
+
+// connLimiter bounds the connections open through the local listeners, in
+// total and by client IP. Clients without an IP address, as those of unix
+// sockets, only count for the total.
+type connLimiter struct {
+	max         int
+	maxByClient int
+	open        int
+	byClient    map[string]int
+	lock        *sync.Mutex
+}
+
+// newConnLimiter reads Limits.MaxStreams and Limits.MaxStreamsPerClient of
+// the host config, returning nil if there is no limit.
+func newConnLimiter(config *viper.Viper) *connLimiter {
+	limiter := &connLimiter{
+		max:         config.GetInt("Limits.MaxStreams"),
+		maxByClient: config.GetInt("Limits.MaxStreamsPerClient"),
+		byClient:    make(map[string]int),
+		lock:        &sync.Mutex{},
+	}
+
+	if limiter.max <= 0 && limiter.maxByClient <= 0 {
+		return nil
+	}
+
+	return limiter
+}
+
+// acquire counts a new connection from addr, returning false if it exceeds
+// the limits. The returned function must be called once it is closed.
+func (l *connLimiter) acquire(addr net.Addr) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+
+	client := ""
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil && net.ParseIP(host) != nil {
+		client = host
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.max > 0 && l.open >= l.max {
+		return nil, false
+	}
+	if client != "" && l.maxByClient > 0 && l.byClient[client] >= l.maxByClient {
+		return nil, false
+	}
+
+	l.open++
+	if client != "" {
+		l.byClient[client]++
+	}
+
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		l.open--
+		if client != "" {
+			if l.byClient[client]--; l.byClient[client] <= 0 {
+				delete(l.byClient, client)
+			}
+		}
+	}, true
+}
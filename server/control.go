@@ -0,0 +1,455 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mitchellh/go-homedir"
+	"github.com/op/go-logging"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultControlSocket = "~/.SaSSHimi.sock"
+
+// ExecProtocol is the protocol a POST /exec switches the connection to, to
+// carry the exec frames of the command.
+const ExecProtocol = "sasshimi-exec"
+
+type ClientInfo struct {
+	Id            string        `json:"id"`
+	Tunnel        string        `json:"tunnel"`
+	Destination   string        `json:"destination"`
+	State         string        `json:"state"`
+	Priority      string        `json:"priority"`
+	Age           time.Duration `json:"age"`
+	BytesSent     uint64        `json:"bytes_sent"`
+	BytesReceived uint64        `json:"bytes_received"`
+}
+
+type TunnelInfo struct {
+	Name       string        `json:"name"`
+	Pool       string        `json:"pool"`
+	RemoteHost string        `json:"remote_host"`
+	Alive      bool          `json:"alive"`
+	Detached   bool          `json:"detached"`
+	Streams    int           `json:"streams"`
+	RTT        time.Duration `json:"rtt"`
+}
+
+// RateLimitInfo has the limits of a tunnel in bytes per second, zero being
+// unlimited.
+type RateLimitInfo struct {
+	Tunnel         string `json:"tunnel"`
+	Upload         int64  `json:"upload"`
+	Download       int64  `json:"download"`
+	StreamUpload   int64  `json:"stream_upload"`
+	StreamDownload int64  `json:"stream_download"`
+}
+
+type ForwardInfo struct {
+	Bind     string `json:"bind"`
+	Protocol string `json:"protocol"`
+	Target   string `json:"target,omitempty"`
+}
+
+// controller keeps the runtime state of a server so it can be inspected and
+// changed while running, through the control socket.
+type controller struct {
+	router    *router
+	listeners map[string]*listener
+	lock      *sync.Mutex
+	ln        net.Listener
+}
+
+func newController(r *router, listeners []*listener) *controller {
+	c := &controller{
+		router:    r,
+		listeners: make(map[string]*listener),
+		lock:      &sync.Mutex{},
+	}
+
+	for _, l := range listeners {
+		c.listeners[l.Bind] = l
+		go l.serve(r)
+	}
+
+	return c
+}
+
+func (c *controller) clients() []ClientInfo {
+	var clients []ClientInfo
+
+	for _, t := range c.router.allTunnels() {
+		t.ClientsLock.Lock()
+		for _, client := range t.Clients {
+			clients = append(clients, ClientInfo{
+				Id:            client.Id,
+				Tunnel:        t.Name,
+				Destination:   client.Destination,
+				State:         client.State(),
+				Priority:      client.Priority.String(),
+				Age:           client.Age(),
+				BytesSent:     client.BytesSent(),
+				BytesReceived: client.BytesReceived(),
+			})
+		}
+		t.ClientsLock.Unlock()
+	}
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Age > clients[j].Age })
+
+	return clients
+}
+
+func (c *controller) tunnels() []TunnelInfo {
+	var tunnels []TunnelInfo
+
+	for _, t := range c.router.allTunnels() {
+		tunnels = append(tunnels, TunnelInfo{
+			Name:       t.Name,
+			Pool:       t.pool.name,
+			RemoteHost: t.getRemoteHost(),
+			Alive:      t.ChannelOpen,
+			Detached:   t.detached,
+			Streams:    t.streams(),
+			RTT:        t.RTT(),
+		})
+	}
+
+	return tunnels
+}
+
+func (c *controller) killClient(clientId string) bool {
+	for _, t := range c.router.allTunnels() {
+		if t.killClient(clientId) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *controller) forwards() []ForwardInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var forwards []ForwardInfo
+	for _, l := range c.listeners {
+		forwards = append(forwards, ForwardInfo{Bind: l.Bind, Protocol: l.Protocol, Target: l.Target})
+	}
+
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].Bind < forwards[j].Bind })
+
+	return forwards
+}
+
+func (c *controller) addForward(bind string, target string) error {
+	config := &listenerConfig{Bind: bind, Protocol: protocolForward, Target: target}
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, prs := c.listeners[bind]; prs {
+		return errors.New("already listening at " + bind)
+	}
+
+	l, err := listen(config)
+	if err != nil {
+		return err
+	}
+
+	c.listeners[bind] = l
+	go l.serve(c.router)
+
+	return nil
+}
+
+func (c *controller) removeForward(bind string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	l, prs := c.listeners[bind]
+	if !prs || l.Protocol != protocolForward {
+		return errors.New("no forward listening at " + bind)
+	}
+
+	delete(c.listeners, bind)
+	logger.Notice("Forward removed from", bind)
+
+	return l.Close()
+}
+
+// matchesHost tells whether a host given to the control socket selects the
+// tunnel, by its name or its remote host with or without the SSH port. An
+// empty host selects all the tunnels.
+func (t *tunnel) matchesHost(host string) bool {
+	if host == "" || host == t.Name {
+		return true
+	}
+
+	if !strings.Contains(host, ":") {
+		host = host + ":22"
+	}
+
+	return host == t.getRemoteHost()
+}
+
+// reconnect replaces the tunnels to remoteHost, or all of them if empty.
+func (c *controller) reconnect(remoteHost string) int {
+	reconnected := 0
+
+	pools := []*tunnelPool{c.router.defaultPool}
+	for _, pool := range c.router.pools {
+		pools = append(pools, pool)
+	}
+
+	for _, pool := range pools {
+		for _, t := range pool.all() {
+			if t.matchesHost(remoteHost) {
+				pool.reconnect(t)
+				reconnected++
+			}
+		}
+	}
+
+	return reconnected
+}
+
+func (c *controller) rateLimits() []RateLimitInfo {
+	var limits []RateLimitInfo
+
+	for _, t := range c.router.allTunnels() {
+		l := t.rateLimits()
+		limits = append(limits, RateLimitInfo{
+			Tunnel:         t.Name,
+			Upload:         l.Upload,
+			Download:       l.Download,
+			StreamUpload:   l.StreamUpload,
+			StreamDownload: l.StreamDownload,
+		})
+	}
+
+	return limits
+}
+
+// setRateLimits changes the given limits, by query parameter name, of the
+// tunnels to remoteHost or of all of them if empty.
+func (c *controller) setRateLimits(remoteHost string, changes map[string]int64) int {
+	changed := 0
+
+	for _, t := range c.router.allTunnels() {
+		if !t.matchesHost(remoteHost) {
+			continue
+		}
+
+		limits := t.rateLimits()
+		for name, rate := range changes {
+			switch name {
+			case "upload":
+				limits.Upload = rate
+			case "download":
+				limits.Download = rate
+			case "stream-upload":
+				limits.StreamUpload = rate
+			case "stream-download":
+				limits.StreamDownload = rate
+			}
+		}
+
+		t.setRateLimits(limits)
+		if t.ChannelOpen {
+			t.SendSettings(t.getAgentSettings())
+		}
+
+		logger.Noticef("Rate limits of %s set to upload %s (%s per stream), download %s (%s per stream)", t.Name,
+			common.FormatRate(limits.Upload), common.FormatRate(limits.StreamUpload),
+			common.FormatRate(limits.Download), common.FormatRate(limits.StreamDownload))
+		changed++
+	}
+
+	return changed
+}
+
+// exec runs request through the tunnels of the host section host, or of the
+// default pool if empty.
+func (c *controller) exec(host string, request *common.ExecRequest) (net.Conn, error) {
+	pool := c.router.defaultPool
+	if host != "" && host != pool.name {
+		var prs bool
+		if pool, prs = c.router.pools[host]; !prs {
+			return nil, errors.New("no tunnels to " + host)
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), clientKey{}, "control")
+	return pool.Exec(ctx, request)
+}
+
+// listen serves the control API as HTTP over a unix socket.
+func (c *controller) listen(socketPath string) {
+	socketPath, err := homedir.Expand(socketPath)
+	if err != nil {
+		logger.Fatal("Invalid control socket path: " + err.Error())
+	}
+
+	// Only the user may connect, from the moment the socket is created
+	var l *listener
+	withUmask(0077, func() {
+		l, err = listen(&listenerConfig{Bind: "unix:" + socketPath, Protocol: "control"})
+	})
+	if err != nil {
+		logger.Fatal("Failed to bind control socket " + err.Error())
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		logger.Fatal("Failed to restrict control socket " + err.Error())
+	}
+
+	c.ln = l.ln
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, c.clients())
+	})
+	mux.HandleFunc("DELETE /clients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !c.killClient(r.PathValue("id")) {
+			http.Error(w, "no such client", http.StatusNotFound)
+		}
+	})
+	mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, c.tunnels())
+	})
+	mux.HandleFunc("POST /tunnels/reconnect", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, c.reconnect(r.URL.Query().Get("host")))
+	})
+	mux.HandleFunc("GET /forwards", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, c.forwards())
+	})
+	mux.HandleFunc("POST /forwards", func(w http.ResponseWriter, r *http.Request) {
+		var forward ForwardInfo
+		if err := json.NewDecoder(r.Body).Decode(&forward); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.addForward(forward.Bind, forward.Target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})
+	mux.HandleFunc("DELETE /forwards", func(w http.ResponseWriter, r *http.Request) {
+		if err := c.removeForward(r.URL.Query().Get("bind")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+	})
+	mux.HandleFunc("GET /ratelimits", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, c.rateLimits())
+	})
+	mux.HandleFunc("PUT /ratelimits", func(w http.ResponseWriter, r *http.Request) {
+		changes := make(map[string]int64)
+		for _, name := range []string{"upload", "download", "stream-upload", "stream-download"} {
+			if !r.URL.Query().Has(name) {
+				continue
+			}
+			rate, err := common.ParseRate(r.URL.Query().Get(name))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			changes[name] = rate
+		}
+		writeJson(w, c.setRateLimits(r.URL.Query().Get("host"), changes))
+	})
+	mux.HandleFunc("POST /exec", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != ExecProtocol {
+			http.Error(w, "expected an upgrade to "+ExecProtocol, http.StatusUpgradeRequired)
+			return
+		}
+		var request common.ExecRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(request.Command) == 0 && request.Tty == nil {
+			http.Error(w, "no command given", http.StatusBadRequest)
+			return
+		}
+		stream, err := c.exec(r.URL.Query().Get("host"), &request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		upgrade(w, ExecProtocol, stream)
+	})
+	mux.HandleFunc("PUT /loglevel", func(w http.ResponseWriter, r *http.Request) {
+		level, err := logging.LogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		module := r.URL.Query().Get("module")
+		utils.SetLogLevel(level, module)
+		logger.Notice("Log level set to", level.String(), module)
+	})
+
+	go http.Serve(c.ln, mux)
+}
+
+func (c *controller) Close() {
+	if c.ln != nil {
+		c.ln.Close()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, l := range c.listeners {
+		l.Close()
+	}
+}
+
+// upgrade switches the connection of a request to protocol and relays it to
+// stream until both are finished.
+func upgrade(w http.ResponseWriter, protocol string, stream net.Conn) {
+	defer stream.Close()
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logger.Errorf("Failed to switch the control connection to %s: %s", protocol, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + protocol + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	splice(conn, rw, stream)
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
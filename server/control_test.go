@@ -0,0 +1,45 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/spf13/viper"
+	"testing"
+)
+
+func TestTunnelMatchesHost(t *testing.T) {
+	v := viper.New()
+	v.Set("RemoteHost", "bastion.example.com")
+	tun := &tunnel{viper: v}
+	tun.Name = "prod"
+
+	tests := []struct {
+		host    string
+		matches bool
+	}{
+		{"", true},
+		{"prod", true},
+		{"bastion.example.com", true},
+		{"bastion.example.com:22", true},
+		{"bastion.example.com:2222", false},
+		{"staging", false},
+	}
+
+	for _, test := range tests {
+		if matches := tun.matchesHost(test.host); matches != test.matches {
+			t.Errorf("matchesHost(%q) = %t, want %t", test.host, matches, test.matches)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"embed"
+	"errors"
+	"io"
+)
+
+// Agent builds embedded by make embed-agents, gzipped, so the stripped agent
+// is uploaded without an agent dir
+//
+//go:embed agents
+var embeddedAgents embed.FS
+
+// embeddedAgent returns the agent embedded for a platform, or nil if there
+// is none.
+func embeddedAgent(p platform) ([]byte, error) {
+	compressed, err := embeddedAgents.ReadFile("agents/SaSSHimi-agent_" + p.OS + "_" + p.Arch + ".gz")
+	if err != nil {
+		return nil, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.New("corrupted embedded agent " + err.Error())
+	}
+
+	return io.ReadAll(reader)
+}
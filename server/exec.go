@@ -0,0 +1,76 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"strings"
+)
+
+// Exec opens a new stream through the tunnel that runs request on the remote
+// host. The returned connection carries the exec frames of the command.
+func (t *tunnel) Exec(ctx context.Context, request *common.ExecRequest) (net.Conn, error) {
+	local, remote := common.Pipe()
+
+	t.ClientsLock.Lock()
+	client := common.NewClient(
+		"exec#"+utils.RandStringRunes(6),
+		remote,
+		t.OutQueue,
+	)
+	client.Destination = "exec " + strings.Join(request.Command, " ")
+	if len(request.Command) == 0 {
+		client.Destination = "shell"
+	}
+	client.Priority = common.PriorityInteractive
+	client.Exec = true
+
+	t.LimitClient(client)
+	t.Clients[client.Id] = client
+	t.ClientsLock.Unlock()
+
+	t.audits.start(ctx, t.Name, client)
+	t.audits.connected(client)
+
+	// Sent before any data so the agent runs the command for the stream
+	open := common.NewMessage(client.Id, []byte{})
+	open.Priority = client.Priority
+	open.Exec = request
+	t.OutQueue.Send(open)
+
+	go func() {
+		if client.ReadFromClientToChannel() {
+			t.removeClient(client, auditRemoteClosed)
+		}
+	}()
+
+	t.streamLogger(client).Infof("Stream opened")
+
+	return local, nil
+}
+
+func (p *tunnelPool) Exec(ctx context.Context, request *common.ExecRequest) (net.Conn, error) {
+	t := p.pick()
+
+	if t == nil {
+		return nil, fmt.Errorf("%w to %s", errNoTunnelAlive, p.name)
+	}
+
+	return t.Exec(ctx, request)
+}
@@ -0,0 +1,173 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Line written by the loaders once the agent can be sent
+const loaderReady = "SASSHIMI LOADER"
+
+// The loaders read the agent size, its SHA-256 and the agent arguments from
+// the command line, then exactly that many bytes from stdin, so the rest of
+// the stream is left for the agent. memfd_noexec 2 forbids running memfds, and
+// with 1 they need MFD_EXEC.
+const pythonLoader = `import os,sys,hashlib
+try:
+    noexec=open("/proc/sys/vm/memfd_noexec").read().strip()
+except OSError:
+    noexec=None
+if noexec=="2":
+    sys.exit("memfd execution disabled")
+fd=os.memfd_create("sasshimi",0 if noexec is None else 16)
+os.write(1,b"` + loaderReady + `\n")
+n=int(sys.argv[1])
+h=hashlib.sha256()
+while n>0:
+    b=os.read(0,min(n,65536))
+    if not b:
+        sys.exit("agent truncated")
+    h.update(b)
+    n-=len(b)
+    while b:
+        b=b[os.write(fd,b):]
+if h.hexdigest()!=sys.argv[2]:
+    sys.exit("agent checksum mismatch")
+os.execv("/proc/self/fd/%d"%fd,["sasshimi"]+sys.argv[3:])
+`
+
+// Perl has no memfd_create, the syscall number depends on the architecture
+const perlLoader = `use Digest::SHA;
+my ($n, $sum, @args) = @ARGV;
+my ($flags, $name) = (0, "sasshimi");
+if (open(my $x, "<", "/proc/sys/vm/memfd_noexec")) { die "memfd execution disabled\n" if <$x> =~ /^2/; $flags = 16; }
+my $fd = syscall(%d, $name, $flags);
+die "memfd_create failed: $!\n" if $fd < 0;
+open(my $m, ">&=", $fd) or die "$!\n";
+syswrite(STDOUT, "` + loaderReady + `\n");
+my $d = Digest::SHA->new(256);
+while ($n > 0) {
+    my $r = sysread(STDIN, my $buf, $n > 65536 ? 65536 : $n);
+    die "agent truncated\n" unless $r;
+    $d->add($buf);
+    $n -= $r;
+    for (my $o = 0; $o < $r;) { my $w = syswrite($m, $buf, $r - $o, $o); die "$!\n" unless defined $w; $o += $w; }
+}
+die "agent checksum mismatch\n" if $d->hexdigest ne $sum;
+exec {"/proc/self/fd/$fd"} "sasshimi", @args;
+die "$!\n";
+`
+
+// memfd_create syscall numbers on Linux
+var memfdSyscalls = map[string]int{
+	"amd64":   319,
+	"386":     356,
+	"arm64":   279,
+	"arm":     385,
+	"riscv64": 279,
+	"ppc64":   360,
+	"ppc64le": 360,
+	"s390x":   350,
+	"mips":    4354,
+	"mips64":  5314,
+}
+
+func (t *tunnel) useFileless() bool {
+	return t.viper.GetBool("Upload.Fileless")
+}
+
+// loaderCommand runs the python loader, or the perl one if python can not
+// create memfds.
+func (t *tunnel) loaderCommand(size int, checksum string, arguments string) string {
+	loaderArguments := fmt.Sprintf(" %d %s %s", size, checksum, arguments)
+
+	command := "export " + logEnv() + "; " +
+		"if python3 -c 'import os; os.memfd_create' 2>/dev/null; then exec python3 -c " + shellQuote(pythonLoader) + loaderArguments + "; fi; "
+
+	if nr, prs := memfdSyscalls[t.remotePlatform.Arch]; prs {
+		command += "exec perl -e " + shellQuote(fmt.Sprintf(perlLoader, nr)) + loaderArguments
+	} else {
+		command += "echo 'no memfd loader available' >&2; exit 1"
+	}
+
+	return command
+}
+
+// launchFileless runs the agent from a memfd, written by a loader that reads
+// it from the session input, so nothing is left on the remote filesystem.
+func (t *tunnel) launchFileless(binary []byte, checksum string, verboseLevel int) error {
+	if t.remotePlatform.OS != "" && t.remotePlatform.OS != "linux" {
+		return errors.New("memfd is only available on Linux")
+	}
+
+	if err := t.openSession(); err != nil {
+		return err
+	}
+
+	t.keepAgent = false
+	t.manifestPath = ""
+	command := t.loaderCommand(len(binary), checksum, t.agentArguments(verboseLevel)+" --fileless")
+
+	if err := t.sshSession.Start(command); err != nil {
+		t.sshSession.Close()
+		return err
+	}
+
+	if err := waitLoader(t.Reader); err != nil {
+		if waitErr := t.sshSession.Wait(); waitErr != nil {
+			err = errors.New(err.Error() + ", " + waitErr.Error())
+		}
+		t.sshSession.Close()
+		return err
+	}
+
+	if _, err := t.Writer.Write(binary); err != nil {
+		t.sshSession.Close()
+		return errors.New("Failed to send the agent: " + err.Error())
+	}
+
+	logger.Info("Agent launched from memory")
+
+	return nil
+}
+
+// waitLoader reads the output of the remote shell up to the loader ready
+// line, one byte at a time to leave the agent output unread.
+func waitLoader(reader io.Reader) error {
+	line := &strings.Builder{}
+	buffer := make([]byte, 1)
+
+	for line.Len() < 4096 {
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			return errors.New("loader not started")
+		}
+
+		if buffer[0] != '\n' {
+			line.WriteByte(buffer[0])
+			continue
+		}
+
+		if line.String() == loaderReady {
+			return nil
+		}
+		line.Reset()
+	}
+
+	return errors.New("unexpected loader output")
+}
@@ -0,0 +1,125 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"net"
+	"net/http"
+)
+
+// authorizedHttp checks the proxy credentials of a request, returning the
+// authenticated user if any.
+func (l *listener) authorizedHttp(req *http.Request) (string, bool) {
+	if len(l.Users) == 0 {
+		return "", true
+	}
+
+	// BasicAuth only looks at the Authorization header
+	header := http.Header{"Authorization": req.Header["Proxy-Authorization"]}
+	user, password, ok := (&http.Request{Header: header}).BasicAuth()
+
+	expected, prs := l.Users[user]
+	return user, ok && prs && expected == password
+}
+
+func writeHttpError(conn net.Conn, status int, message string) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n",
+		status, http.StatusText(status), len(message))
+
+	if status == http.StatusProxyAuthRequired {
+		fmt.Fprint(conn, "Proxy-Authenticate: Basic realm=\"SaSSHimi\"\r\n")
+	}
+
+	fmt.Fprintf(conn, "\r\n%s", message)
+}
+
+// serveHttp handles one request of an HTTP proxy client. CONNECT requests
+// become a raw stream, any other request is sent to its origin server with
+// the connection closed after the response.
+func (l *listener) serveHttp(conn net.Conn, r *router) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		logger.Debug("Invalid HTTP proxy request:", err.Error())
+		return
+	}
+
+	user, authorized := l.authorizedHttp(req)
+	if !authorized {
+		logger.Warningf("Unauthorized HTTP proxy request from %s", conn.RemoteAddr().String())
+		writeHttpError(conn, http.StatusProxyAuthRequired, "proxy authentication required")
+		return
+	}
+
+	target := req.Host
+	if req.Method != http.MethodConnect {
+		target = req.URL.Host
+	}
+
+	// Absolute-form requests take the port of their scheme
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		port := "80"
+		if req.Method == http.MethodConnect || req.URL.Scheme == "https" {
+			port = "443"
+		}
+		target = net.JoinHostPort(target, port)
+	}
+
+	ctx := context.Background()
+	if user != "" {
+		ctx = context.WithValue(ctx, userKey{}, user)
+	}
+
+	remote, err := r.connect(ctx, conn.RemoteAddr().String(), target)
+	if err != nil {
+		status := http.StatusBadGateway
+		if err == common.SocksReplyError(2) {
+			status = http.StatusForbidden
+		}
+		writeHttpError(conn, status, err.Error())
+		return
+	}
+	defer remote.Close()
+
+	if req.Method == http.MethodConnect {
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		splice(conn, reader, remote)
+		return
+	}
+
+	// The client expects the proxy to talk TLS to https origins
+	if req.URL.Scheme == "https" {
+		remote = tls.Client(remote, &tls.Config{ServerName: req.URL.Hostname()})
+	}
+
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Close = true
+
+	if err := req.Write(remote); err != nil {
+		writeHttpError(conn, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	splice(conn, reader, remote)
+}
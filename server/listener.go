@@ -0,0 +1,272 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/metrics"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	protocolSocks5   = "socks5"
+	protocolHttp     = "http"
+	protocolForward  = "forward"
+	protocolRedirect = "redirect"
+)
+
+const DefaultBindAddress = "127.0.0.1:1080"
+
+// listenerConfig describes a local listener. Bind is a TCP address (IPv4 or
+// IPv6) or a unix socket path prefixed by "unix:". Target is the destination
+// of forward listeners and Users, if any, the credentials required by socks5
+// and http listeners.
+type listenerConfig struct {
+	Bind     string
+	Protocol string
+	Target   string
+	Users    map[string]string
+}
+
+type listener struct {
+	listenerConfig
+	ln net.Listener
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// parseBind parses a listener from the command line, with the syntax
+// [protocol://][user:password@]address[/target]
+func parseBind(bind string) (*listenerConfig, error) {
+	config := &listenerConfig{Protocol: protocolSocks5}
+
+	if idx := strings.Index(bind, "://"); idx >= 0 {
+		config.Protocol, bind = bind[:idx], bind[idx+3:]
+	}
+
+	if idx := strings.LastIndex(bind, "@"); idx >= 0 {
+		credentials := strings.SplitN(bind[:idx], ":", 2)
+		if len(credentials) != 2 {
+			return nil, errors.New("credentials must be user:password")
+		}
+		config.Users = map[string]string{credentials[0]: credentials[1]}
+		bind = bind[idx+1:]
+	}
+
+	if config.Protocol == protocolForward {
+		idx := strings.LastIndex(bind, "/")
+		if idx < 0 {
+			return nil, errors.New("forward listeners need a target, as address/host:port")
+		}
+		bind, config.Target = bind[:idx], bind[idx+1:]
+	}
+
+	config.Bind = bind
+
+	return config, config.validate()
+}
+
+func (c *listenerConfig) validate() error {
+	switch c.Protocol {
+	case protocolSocks5, protocolHttp, protocolRedirect:
+	case protocolForward:
+		if _, _, err := net.SplitHostPort(c.Target); err != nil {
+			return errors.New("invalid forward target: " + err.Error())
+		}
+	default:
+		return errors.New("unknown listener protocol " + c.Protocol)
+	}
+
+	if c.Bind == "" {
+		return errors.New("missing bind address")
+	}
+
+	if len(c.Users) > 0 && c.Protocol != protocolSocks5 && c.Protocol != protocolHttp {
+		return errors.New(c.Protocol + " listeners do not support authentication")
+	}
+
+	return nil
+}
+
+// loadListeners merges the Listeners of the host config with the ones given
+// on the command line and binds all of them.
+func loadListeners(config *viper.Viper, bindAddresses []string) []*listener {
+	var configs []*listenerConfig
+
+	if err := config.UnmarshalKey("Listeners", &configs); err != nil {
+		logger.Fatal("Unable to parse listeners: " + err.Error())
+	}
+
+	for _, c := range configs {
+		if c.Protocol == "" {
+			c.Protocol = protocolSocks5
+		}
+		if err := c.validate(); err != nil {
+			logger.Fatalf("Invalid listener %s: %s", c.Bind, err.Error())
+		}
+	}
+
+	for _, bind := range bindAddresses {
+		c, err := parseBind(bind)
+		if err != nil {
+			logger.Fatalf("Invalid bind %s: %s", bind, err.Error())
+		}
+		configs = append(configs, c)
+	}
+
+	if len(configs) == 0 {
+		configs = append(configs, &listenerConfig{Bind: DefaultBindAddress, Protocol: protocolSocks5})
+	}
+
+	var listeners []*listener
+	for _, c := range configs {
+		l, err := listen(c)
+		if err != nil {
+			panic("Failed to bind local address " + err.Error())
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners
+}
+
+func listen(config *listenerConfig) (*listener, error) {
+	network, address := "tcp", config.Bind
+
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+
+		// Remove stale sockets left by a previous run, not the live ones
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", address); err == nil {
+				conn.Close()
+				return nil, errors.New(address + " is in use by another process")
+			}
+			os.Remove(address)
+		}
+	}
+
+	ln, err := net.Listen(network, address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Noticef("%s listener bind at %s", config.Protocol, config.Bind)
+
+	return &listener{
+		listenerConfig: *config,
+		ln:             ln,
+	}, nil
+}
+
+func (l *listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *listener) serve(r *router) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Errorf("Error in conncetion accept: %s", err.Error())
+			continue
+		}
+
+		logger.Debugf("New %s connection from %s", l.Protocol, conn.RemoteAddr().String())
+		metrics.Accepted.With(l.Protocol).Inc()
+
+		release, ok := r.limiter.acquire(conn.RemoteAddr())
+		if !ok {
+			utils.WithFields(logger, utils.Fields{"client": conn.RemoteAddr().String()}).Warningf("Connection refused, too many streams")
+			metrics.DialFailures.With("limit").Inc()
+			conn.Close()
+			continue
+		}
+
+		go func(conn net.Conn) {
+			defer release()
+
+			switch l.Protocol {
+			case protocolSocks5:
+				l.serveSocks(conn, r)
+			case protocolHttp:
+				l.serveHttp(conn, r)
+			case protocolForward:
+				l.serveForward(conn, r, l.Target)
+			case protocolRedirect:
+				l.serveRedirect(conn, r)
+			}
+		}(conn)
+	}
+}
+
+func (l *listener) serveForward(conn net.Conn, r *router, target string) {
+	defer conn.Close()
+
+	remote, err := r.connect(context.Background(), conn.RemoteAddr().String(), target)
+	if err != nil {
+		logger.Errorf("Failed to forward %s to %s: %s", conn.RemoteAddr().String(), target, err.Error())
+		return
+	}
+	defer remote.Close()
+
+	splice(conn, conn, remote)
+}
+
+func (l *listener) serveRedirect(conn net.Conn, r *router) {
+	target, err := originalDestination(conn)
+	if err != nil {
+		logger.Errorf("Unable to get original destination of %s: %s", conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+
+	l.serveForward(conn, r, target)
+}
+
+// splice copies data both ways between a local connection, read through
+// clientReader, and a remote one until both directions are finished.
+func splice(client net.Conn, clientReader io.Reader, remote net.Conn) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+
+	copyHalf := func(dst net.Conn, src io.Reader) {
+		defer wg.Done()
+		io.Copy(dst, src)
+
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	go copyHalf(remote, clientReader)
+	go copyHalf(client, remote)
+
+	wg.Wait()
+}
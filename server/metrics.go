@@ -0,0 +1,94 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/metrics"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+var dialFailureReasons = map[common.SocksReplyError]string{
+	1: "server_failure",
+	2: "denied",
+	3: "network_unreachable",
+	4: "host_unreachable",
+	5: "refused",
+	6: "ttl_expired",
+}
+
+// serveMetrics serves the metrics in Prometheus text format at
+// http://address/metrics.
+func serveMetrics(address string, r *router) {
+	collectTunnels := func(f *metrics.Family, value func(t *tunnel) float64) {
+		f.Reset()
+		for _, t := range r.allTunnels() {
+			f.With(t.pool.name, t.Name).Set(value(t))
+		}
+	}
+
+	metrics.ActiveStreams.OnCollect(func(f *metrics.Family) {
+		collectTunnels(f, func(t *tunnel) float64 { return float64(t.streams()) })
+	})
+	metrics.TunnelUp.OnCollect(func(f *metrics.Family) {
+		collectTunnels(f, func(t *tunnel) float64 {
+			if t.ChannelOpen {
+				return 1
+			}
+			return 0
+		})
+	})
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		logger.Fatal("Failed to bind metrics address " + err.Error())
+	}
+
+	logger.Noticef("Metrics served at http://%s/metrics", address)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	go http.Serve(ln, mux)
+}
+
+// dialFailureReason classifies a dial error for the metrics.
+func dialFailureReason(err error) string {
+	var replyErr common.SocksReplyError
+	if errors.As(err, &replyErr) {
+		if reason, ok := dialFailureReasons[replyErr]; ok {
+			return reason
+		}
+		return "socks_error"
+	}
+
+	if errors.Is(err, errNoTunnelAlive) {
+		return "no_tunnel"
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "refused"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+
+	return "error"
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+const ip6tSoOriginalDst = 80
+
+// originalDestination returns the address a connection redirected by
+// iptables/nftables was originally sent to.
+func originalDestination(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("redirect listeners need a TCP connection")
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var addr string
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		if tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+			// The sockaddr_in fits in the buffer of an ipv6_mreq
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			addr = net.JoinHostPort(net.IP(mreq.Multiaddr[4:8]).String(), strconv.Itoa(int(port)))
+		} else {
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			// Port is kept in network byte order
+			rawPort := binary.NativeEndian.AppendUint16(nil, info.Addr.Port)
+			port := binary.BigEndian.Uint16(rawPort)
+			addr = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port)))
+		}
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return addr, sockErr
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func originalDestination(conn net.Conn) (string, error) {
+	return "", errors.New("redirect listeners are only supported on linux")
+}
@@ -0,0 +1,185 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"time"
+)
+
+// Interval of the SSH keep alives of persistent tunnels, a connection not
+// answering one in time is considered lost
+const persistKeepAlive = 15 * time.Second
+
+// Longest wait between attempts to reattach
+const maxReattachDelay = 30 * time.Second
+
+// getPersist returns how long the agent keeps the streams without server,
+// zero if it does not persist.
+func (t *tunnel) getPersist() time.Duration {
+	value := t.viper.GetString("Persist")
+	if value == "" {
+		return 0
+	}
+
+	persist, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Fatalf("Invalid Persist: %s", err.Error())
+	}
+
+	return persist
+}
+
+// prepareSession chooses the socket and the token of a persistent agent. The
+// socket is in the user directory, so only the user reaches it.
+func (t *tunnel) prepareSession(userDir string) {
+	t.sessionPath, t.sessionToken = "", ""
+
+	if t.getPersist() <= 0 {
+		return
+	}
+
+	if userDir == "" {
+		logger.Warning("No private remote directory, the agent will not persist")
+		return
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		logger.Warning("Unable to create a session token, the agent will not persist: " + err.Error())
+		return
+	}
+
+	t.sessionPath = userDir + "/" + utils.RandStringRunes(10) + ".session"
+	t.sessionToken = hex.EncodeToString(token)
+}
+
+// serveSession carries the channel through the agent session until run, which
+// runs or waits for its command, returns. It tells if the connection was lost
+// while the agent persists.
+func (t *tunnel) serveSession(run func() error) bool {
+	defer t.sshSession.Close()
+
+	if t.sessionToken == "" {
+		go t.ReadInputData()
+		go t.WriteOutputData()
+
+		run()
+		return false
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go t.watchConnection(t.sshClient, done)
+
+	// The token goes first, before the channel
+	reader, writer := t.Reader, t.Writer
+	go func() {
+		if _, err := io.WriteString(writer, t.sessionToken+"\n"); err == nil {
+			t.RunTransport(reader, writer)
+		}
+	}()
+
+	// An exit status means the agent, or its relay, ended
+	var exitError *ssh.ExitError
+	err := run()
+	return err != nil && !errors.As(err, &exitError)
+}
+
+// watchConnection closes the SSH connection when it stops answering, so it is
+// noticed as lost even if TCP does not notice.
+func (t *tunnel) watchConnection(client *ssh.Client, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(persistKeepAlive):
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case <-done:
+			return
+		case err := <-replied:
+			if err == nil {
+				continue
+			}
+		case <-time.After(persistKeepAlive):
+		}
+
+		logger.Warningf("SSH connection of %s not answering, closing it", t.Name)
+		client.Close()
+		return
+	}
+}
+
+// reattach connects again to the persistent agent after the connection was
+// lost, while the agent waits for it. It tells if the connection was lost
+// again.
+func (t *tunnel) reattach() bool {
+	t.detached = true
+	defer func() {
+		t.detached = false
+	}()
+
+	persist := t.getPersist()
+	deadline := time.Now().Add(persist)
+	logger.Warningf("Connection of %s lost, reattaching to its agent", t.Name)
+
+	for delay := time.Second; !t.closing; delay *= 2 {
+		if delay > maxReattachDelay {
+			delay = maxReattachDelay
+		}
+
+		err := t.dial()
+		if err == nil {
+			if err = t.openSession(); err != nil {
+				t.sshClient.Close()
+			}
+		}
+
+		if err == nil {
+			defer t.sshClient.Close()
+
+			logger.Noticef("Reattached to the agent of %s", t.Name)
+			t.detached = false
+
+			command := logEnv() + " " + shellQuote(t.daemonPath) + " agent --attach " + shellQuote(t.sessionPath)
+			return t.serveSession(func() error {
+				return t.sshSession.Run(command)
+			})
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			logger.Errorf("Unable to reattach to the agent of %s within %s: %s", t.Name, persist, err.Error())
+			return false
+		}
+
+		logger.Warningf("Reattach to %s failed, retrying in %s: %s", t.Name, delay, err.Error())
+		time.Sleep(delay)
+	}
+
+	return false
+}
@@ -0,0 +1,183 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"github.com/mitchellh/go-homedir"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Directory with the agent builds for other platforms, named as
+// SaSSHimi-agent_<os>_<arch> for the agent alone, built from
+// cmd/sasshimi-agent, or SaSSHimi_<os>_<arch> for the whole tool
+const DefaultAgentDir = "~/.SaSSHimi/agents"
+
+// platform is a Go target, as GOOS/GOARCH.
+type platform struct {
+	OS   string
+	Arch string
+}
+
+func (p platform) String() string {
+	return p.OS + "/" + p.Arch
+}
+
+var localPlatform = platform{runtime.GOOS, runtime.GOARCH}
+
+var unameSystems = map[string]string{
+	"Linux":     "linux",
+	"Darwin":    "darwin",
+	"FreeBSD":   "freebsd",
+	"OpenBSD":   "openbsd",
+	"NetBSD":    "netbsd",
+	"DragonFly": "dragonfly",
+	"SunOS":     "solaris",
+}
+
+var unameMachines = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"i386":    "386",
+	"i486":    "386",
+	"i586":    "386",
+	"i686":    "386",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv8l":  "arm",
+	"mips":    "mips",
+	"mips64":  "mips64",
+	"ppc64le": "ppc64le",
+	"ppc64":   "ppc64",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+// parseUname returns the platform given by the output of uname -sm. On
+// i86pc, the machine of both 32 and 64 bit illumos and Solaris, it is
+// followed by the output of isainfo -k.
+func parseUname(output string) (platform, error) {
+	fields := strings.Fields(output)
+	if len(fields) == 3 && fields[1] == "i86pc" {
+		fields = []string{fields[0], fields[2]}
+	}
+	if len(fields) != 2 {
+		return platform{}, errors.New("unexpected uname output " + strings.TrimSpace(output))
+	}
+
+	system, prs := unameSystems[fields[0]]
+	if !prs {
+		return platform{}, errors.New("unsupported system " + fields[0])
+	}
+
+	arch, prs := unameMachines[fields[1]]
+	if !prs && strings.HasPrefix(fields[1], "arm") {
+		arch, prs = "arm", true
+	}
+	if !prs {
+		return platform{}, errors.New("unsupported machine " + fields[1])
+	}
+
+	return platform{system, arch}, nil
+}
+
+// probePlatform asks the remote host for its platform.
+func (t *tunnel) probePlatform() (platform, error) {
+	output, err := runRemote(t.sshClient, nil, `uname -sm && if [ "$(uname -m)" = i86pc ]; then isainfo -k; fi`)
+	if err != nil {
+		return platform{}, err
+	}
+
+	return parseUname(string(output))
+}
+
+func (t *tunnel) getAgentDir() string {
+	dir := t.viper.GetString("AgentDir")
+	if dir == "" {
+		dir = DefaultAgentDir
+	}
+
+	expanded, err := homedir.Expand(dir)
+	if err != nil {
+		logger.Fatal("Invalid agent dir: " + err.Error())
+	}
+
+	return expanded
+}
+
+// findAgentBuild returns the build for a platform in the agent dir, the agent
+// alone being preferred over the whole tool.
+func (t *tunnel) findAgentBuild(p platform) string {
+	for _, name := range []string{"SaSSHimi-agent_", "SaSSHimi_"} {
+		path := filepath.Join(t.getAgentDir(), name+p.OS+"_"+p.Arch)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// agentBinary returns the agent to upload: RemoteExecutable if set, or the
+// build for the remote platform in the agent dir, or the one embedded, or
+// this binary if the remote platform is the local one.
+func (t *tunnel) agentBinary() ([]byte, error) {
+	if remoteExecutable := t.getRemoteExecutable(); remoteExecutable != "" {
+		return readBinary(remoteExecutable)
+	}
+
+	remote, err := t.probePlatform()
+	if err != nil {
+		return nil, errors.New("unable to detect the remote platform, set RemoteExecutable: " + err.Error())
+	}
+
+	logger.Debug("Remote platform:", remote.String())
+	t.remotePlatform = remote
+
+	if path := t.findAgentBuild(remote); path != "" {
+		logger.Infof("Using the %s agent %s", remote, path)
+		return readBinary(path)
+	}
+
+	binary, err := embeddedAgent(remote)
+	if binary != nil || err != nil {
+		logger.Infof("Using the embedded %s agent", remote)
+		return binary, err
+	}
+
+	if remote == localPlatform {
+		logger.Info("No agent build found, using this whole binary as the agent")
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		return readBinary(self)
+	}
+
+	path := filepath.Join(t.getAgentDir(), "SaSSHimi-agent_"+remote.OS+"_"+remote.Arch)
+	return nil, errors.New("no agent build for " + remote.String() + ", the remote platform: put one at " + path +
+		" (GOOS=" + remote.OS + " GOARCH=" + remote.Arch + " go build -o " + path + " ./cmd/sasshimi-agent) or set RemoteExecutable")
+}
+
+func readBinary(path string) ([]byte, error) {
+	binary, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Failed to open agent binary " + err.Error())
+	}
+	return binary, nil
+}
@@ -0,0 +1,50 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestParseUname(t *testing.T) {
+	tests := []struct {
+		output string
+		want   platform
+	}{
+		{"Linux x86_64\n", platform{"linux", "amd64"}},
+		{"Linux armv7l\n", platform{"linux", "arm"}},
+		{"Darwin arm64\n", platform{"darwin", "arm64"}},
+		{"FreeBSD amd64\n", platform{"freebsd", "amd64"}},
+		{"SunOS i86pc\namd64\n", platform{"solaris", "amd64"}},
+		{"SunOS i86pc\ni386\n", platform{"solaris", "386"}},
+	}
+
+	for _, test := range tests {
+		got, err := parseUname(test.output)
+		if err != nil {
+			t.Errorf("parseUname(%q) failed: %s", test.output, err.Error())
+		} else if got != test.want {
+			t.Errorf("parseUname(%q) = %s, want %s", test.output, got, test.want)
+		}
+	}
+}
+
+func TestParseUnameErrors(t *testing.T) {
+	for _, output := range []string{"", "Linux", "SunOS i86pc\n", "Windows_NT x86_64", "Linux sparc64", "Linux x86_64 extra"} {
+		if _, err := parseUname(output); err == nil {
+			t.Errorf("parseUname(%q) did not fail", output)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"github.com/mitchellh/go-homedir"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/spf13/viper"
+)
+
+// loadPolicy reads a destination policy from a YAML, JSON or TOML file.
+func loadPolicy(policyFilePath string) (*common.Policy, error) {
+	policyFilePath, err := homedir.Expand(policyFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	policyViper := viper.New()
+	policyViper.SetConfigFile(policyFilePath)
+
+	if err := policyViper.ReadInConfig(); err != nil {
+		return nil, errors.New("unable to read policy file: " + err.Error())
+	}
+
+	policy := &common.Policy{}
+	if err := policyViper.Unmarshal(policy); err != nil {
+		return nil, errors.New("unable to parse policy file: " + err.Error())
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, errors.New("invalid policy: " + err.Error())
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,258 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/metrics"
+	"github.com/spf13/viper"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	balanceRoundRobin   = "round-robin"
+	balanceLeastStreams = "least-streams"
+	balanceLatency      = "latency"
+)
+
+var errNoTunnelAlive = errors.New("no tunnel alive")
+
+// Latency assumed for tunnels that have not answered a keep alive yet
+const unknownLatency = 100 * time.Millisecond
+
+// tunnelPool groups equivalent tunnels and spreads new streams among the
+// ones still alive, so a dead tunnel only takes its own streams down.
+type tunnelPool struct {
+	name    string
+	tunnels []*tunnel
+	balance string
+	next    uint32
+	lock    *sync.Mutex
+}
+
+// hostSectionConfig returns the config of a host section of the config file,
+// inheriting the command line defaults of the main host.
+func hostSectionConfig(name string, defaults *viper.Viper) *viper.Viper {
+	sectionConfig := viper.Sub(name)
+	if sectionConfig == nil {
+		logger.Fatalf("Unknown host section %s", name)
+	}
+
+	sectionConfig.SetDefault("RemoteHost", name)
+	sectionConfig.SetDefault("PrivateKey", defaults.GetString("PrivateKey"))
+	sectionConfig.SetDefault("RemoteExecutable", defaults.GetString("RemoteExecutable"))
+	sectionConfig.SetDefault("AgentDir", defaults.GetString("AgentDir"))
+	sectionConfig.SetDefault("Upload.Methods", defaults.GetStringSlice("Upload.Methods"))
+	sectionConfig.SetDefault("Upload.Directories", defaults.GetStringSlice("Upload.Directories"))
+	sectionConfig.SetDefault("Upload.Cache", defaults.GetBool("Upload.Cache"))
+	sectionConfig.SetDefault("Upload.Fileless", defaults.GetBool("Upload.Fileless"))
+	sectionConfig.SetDefault("Upload.Compress", defaults.GetBool("Upload.Compress"))
+	sectionConfig.SetDefault("Persist", defaults.GetString("Persist"))
+	sectionConfig.SetDefault("AgentHttp", defaults.GetBool("AgentHttp"))
+
+	return sectionConfig
+}
+
+// newTunnelPool creates Pool.Size tunnels to the host of config and to every
+// equivalent host section listed in Pool.Hosts.
+func newTunnelPool(name string, config *viper.Viper) *tunnelPool {
+	pool := &tunnelPool{
+		name:    name,
+		balance: config.GetString("Pool.Balance"),
+		lock:    &sync.Mutex{},
+	}
+
+	switch pool.balance {
+	case "":
+		pool.balance = balanceRoundRobin
+	case balanceRoundRobin, balanceLeastStreams, balanceLatency:
+	default:
+		logger.Fatalf("Unknown balance strategy %s for %s", pool.balance, name)
+	}
+
+	size := config.GetInt("Pool.Size")
+	if size < 1 {
+		size = 1
+	}
+
+	hostConfigs := []*viper.Viper{config}
+	for _, host := range config.GetStringSlice("Pool.Hosts") {
+		hostConfig := hostSectionConfig(host, config)
+		hostConfig.SetDefault("Policy", config.GetString("Policy"))
+		hostConfigs = append(hostConfigs, hostConfig)
+	}
+
+	for _, hostConfig := range hostConfigs {
+		for i := 0; i < size; i++ {
+			t := newTunnel(hostConfig)
+			t.pool = pool
+			if size > 1 {
+				t.Name = fmt.Sprintf("%s#%d", t.Name, i+1)
+			}
+			pool.tunnels = append(pool.tunnels, t)
+		}
+	}
+
+	if !pool.samePolicies() {
+		logger.Fatalf("Hosts of pool %s have different policies", name)
+	}
+
+	logger.Debugf("Pool %s: %d tunnels balanced by %s", name, len(pool.tunnels), pool.balance)
+
+	return pool
+}
+
+func newSingleTunnelPool(name string, t *tunnel) *tunnelPool {
+	pool := &tunnelPool{
+		name:    name,
+		tunnels: []*tunnel{t},
+		balance: balanceRoundRobin,
+		lock:    &sync.Mutex{},
+	}
+	t.pool = pool
+
+	return pool
+}
+
+func (p *tunnelPool) all() []*tunnel {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]*tunnel{}, p.tunnels...)
+}
+
+func (p *tunnelPool) alive() []*tunnel {
+	var alive []*tunnel
+	for _, t := range p.all() {
+		if t.ChannelOpen {
+			alive = append(alive, t)
+		}
+	}
+	return alive
+}
+
+// policy returns the policy of the pool, the same for all its tunnels as it
+// is checked before one of them is picked.
+func (p *tunnelPool) policy() *common.Policy {
+	return p.all()[0].policy
+}
+
+func (p *tunnelPool) samePolicies() bool {
+	tunnels := p.all()
+	for _, t := range tunnels[1:] {
+		if !reflect.DeepEqual(t.policy, tunnels[0].policy) {
+			return false
+		}
+	}
+	return true
+}
+
+// reconnect replaces a tunnel of the pool by a new one to the same host. The
+// streams of the old tunnel are lost.
+func (p *tunnelPool) reconnect(old *tunnel) {
+	t := newTunnel(old.viper)
+	t.pool = p
+	t.Name = old.Name
+	t.setRateLimits(old.rateLimits())
+
+	p.lock.Lock()
+	for i := range p.tunnels {
+		if p.tunnels[i] == old {
+			p.tunnels[i] = t
+		}
+	}
+	p.lock.Unlock()
+
+	logger.Notice("Reconnecting tunnel to", old.getRemoteHost())
+	metrics.Reconnects.With(t.Name).Inc()
+
+	t.start(old.verboseLevel)
+	go old.shutdown()
+}
+
+// pick chooses the tunnel for a new stream, or nil if all of them are dead.
+func (p *tunnelPool) pick() *tunnel {
+	alive := p.alive()
+
+	if len(alive) == 0 {
+		return nil
+	}
+
+	// Detached tunnels hold new streams until they reattach, avoid them
+	var attached []*tunnel
+	for _, t := range alive {
+		if !t.detached {
+			attached = append(attached, t)
+		}
+	}
+	if len(attached) > 0 {
+		alive = attached
+	}
+
+	switch p.balance {
+	case balanceLeastStreams:
+		best, bestStreams := alive[0], alive[0].streams()
+		for _, t := range alive[1:] {
+			if streams := t.streams(); streams < bestStreams {
+				best, bestStreams = t, streams
+			}
+		}
+		return best
+
+	case balanceLatency:
+		// Weighted random choice, the weight being the inverse of the latency
+		weights := make([]float64, len(alive))
+		total := 0.0
+		for i, t := range alive {
+			rtt := t.RTT()
+			if rtt <= 0 {
+				rtt = unknownLatency
+			}
+			weights[i] = 1 / rtt.Seconds()
+			total += weights[i]
+		}
+
+		choice := rand.Float64() * total
+		for i, weight := range weights {
+			if choice < weight {
+				return alive[i]
+			}
+			choice -= weight
+		}
+		return alive[len(alive)-1]
+
+	default:
+		next := atomic.AddUint32(&p.next, 1)
+		return alive[int(next)%len(alive)]
+	}
+}
+
+func (p *tunnelPool) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	t := p.pick()
+
+	if t == nil {
+		return nil, fmt.Errorf("%w to %s", errNoTunnelAlive, p.name)
+	}
+
+	return t.Dial(ctx, network, addr)
+}
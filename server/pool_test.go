@@ -0,0 +1,55 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"sync"
+	"testing"
+)
+
+func TestTunnelPoolSamePolicies(t *testing.T) {
+	policy := func(action string) *common.Policy {
+		return &common.Policy{
+			Default: common.PolicyDeny,
+			Rules: []common.PolicyRule{
+				{DestinationMatcher: common.DestinationMatcher{Hosts: []string{"10.0.0.0/8"}}, Action: action},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		policies []*common.Policy
+		same     bool
+	}{
+		{"single tunnel", []*common.Policy{policy(common.PolicyAllow)}, true},
+		{"equal policies", []*common.Policy{policy(common.PolicyAllow), policy(common.PolicyAllow)}, true},
+		{"no policies", []*common.Policy{nil, nil}, true},
+		{"different rules", []*common.Policy{policy(common.PolicyAllow), policy(common.PolicyDeny)}, false},
+		{"policy on one host only", []*common.Policy{policy(common.PolicyAllow), nil}, false},
+	}
+
+	for _, test := range tests {
+		pool := &tunnelPool{lock: &sync.Mutex{}}
+		for _, p := range test.policies {
+			pool.tunnels = append(pool.tunnels, &tunnel{policy: p})
+		}
+
+		if same := pool.samePolicies(); same != test.same {
+			t.Errorf("%s: samePolicies() = %t, want %t", test.name, same, test.same)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"net"
+	"strconv"
+)
+
+// priorityRule puts the streams to the matching destinations in a QoS class
+// (interactive, default or bulk).
+type priorityRule struct {
+	common.DestinationMatcher `mapstructure:",squash"`
+	Class                     string
+	priority                  common.Priority
+}
+
+// getPriorities reads the Priorities of the host section.
+func (t *tunnel) getPriorities() []priorityRule {
+	var rules []priorityRule
+
+	if err := t.viper.UnmarshalKey("Priorities", &rules); err != nil {
+		logger.Fatal("Unable to parse priorities: " + err.Error())
+	}
+
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			logger.Fatalf("Invalid priority %d: %s", i+1, err.Error())
+		}
+
+		priority, err := common.ParsePriority(rules[i].Class)
+		if err != nil {
+			logger.Fatalf("Invalid priority %d: %s", i+1, err.Error())
+		}
+		rules[i].priority = priority
+	}
+
+	return rules
+}
+
+// priorityOf returns the class of the first rule matching addr, or the
+// default one.
+func (t *tunnel) priorityOf(addr string) common.Priority {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return common.PriorityDefault
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	for _, rule := range t.priorities {
+		if rule.Matches(host, net.ParseIP(host), port) {
+			return rule.priority
+		}
+	}
+
+	return common.PriorityDefault
+}
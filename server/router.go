@@ -0,0 +1,200 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/metrics"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"net"
+	"strconv"
+)
+
+const (
+	routeDirect = "direct"
+	routeReject = "reject"
+)
+
+// route sends the matching destinations through the tunnel of the host
+// section named by Via, or to one of the special targets direct and reject.
+type route struct {
+	common.DestinationMatcher `mapstructure:",squash"`
+	Via                       string
+}
+
+type routeKey struct{}
+type clientKey struct{}
+type userKey struct{}
+
+// router chooses, for every SOCKS request, the tunnel pool that should carry
+// it. Requests not matching any route go through the default pool.
+type router struct {
+	routes      []route
+	pools       map[string]*tunnelPool
+	defaultPool *tunnelPool
+	limiter     *connLimiter
+}
+
+func newRouter(defaultPool *tunnelPool) *router {
+	return &router{
+		pools:       make(map[string]*tunnelPool),
+		defaultPool: defaultPool,
+	}
+}
+
+// loadRoutes reads the Routes of the host config and creates one tunnel pool
+// for every host section they refer to.
+func (r *router) loadRoutes(config *viper.Viper) {
+	if err := config.UnmarshalKey("Routes", &r.routes); err != nil {
+		logger.Fatal("Unable to parse routes: " + err.Error())
+	}
+
+	for i, rt := range r.routes {
+		if err := rt.Validate(); err != nil {
+			logger.Fatalf("Invalid route %d: %s", i+1, err.Error())
+		}
+
+		if rt.Via == "" || rt.Via == routeDirect || rt.Via == routeReject {
+			continue
+		}
+
+		if _, prs := r.pools[rt.Via]; prs {
+			continue
+		}
+
+		logger.Debug("Route tunnel:", rt.Via)
+		r.pools[rt.Via] = newTunnelPool(rt.Via, hostSectionConfig(rt.Via, config))
+	}
+}
+
+func (r *router) allTunnels() []*tunnel {
+	tunnels := r.defaultPool.all()
+	for _, pool := range r.pools {
+		tunnels = append(tunnels, pool.all()...)
+	}
+	return tunnels
+}
+
+// target returns the name of the route for a destination. An empty name
+// stands for the default pool.
+func (r *router) target(host string, ip net.IP, port int) string {
+	for _, rt := range r.routes {
+		if rt.Matches(host, ip, port) {
+			return rt.Via
+		}
+	}
+	return ""
+}
+
+// authorize returns the route for a destination and whether it is allowed,
+// that is, not routed to reject and permitted by the policy of its tunnel.
+// Names the policy cannot decide without their address are left to the
+// agent, except on direct routes.
+func (r *router) authorize(ctx context.Context, host string, ip net.IP, port int) (string, bool) {
+	hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+	via := r.target(host, ip, port)
+
+	if via == routeReject {
+		utils.WithFields(logger, utils.Fields{"destination": hostPort}).Warningf("Connection rejected by route")
+		metrics.DialFailures.With("rejected").Inc()
+		auditRefused(ctx, hostPort, "", auditRejected)
+		return via, false
+	}
+
+	policy := r.defaultPool.policy()
+	if pool, prs := r.pools[via]; prs {
+		policy = pool.policy()
+	}
+
+	permitted, decided := policy.Decide(host, ip, port)
+	if !decided {
+		if via != routeDirect {
+			// Left to the agent, which resolves the name
+			logger.Debugf("Policy of %s decided by the agent", hostPort)
+			return via, true
+		}
+
+		// No agent on direct routes, the name is resolved here
+		ip, _ = common.NewResolver(nil).LookupIP(ctx, host)
+		permitted = policy.Permits(host, ip, port)
+	}
+
+	if !permitted {
+		utils.WithFields(logger, utils.Fields{"destination": hostPort}).Warningf("Connection denied by policy")
+		metrics.DialFailures.With("denied").Inc()
+		auditRefused(ctx, hostPort, via, auditDenied)
+		return via, false
+	}
+
+	return via, true
+}
+
+// connect authorizes and dials addr on behalf of clientAddr for the
+// listeners.
+func (r *router) connect(ctx context.Context, clientAddr string, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.New("invalid port " + portStr)
+	}
+
+	ctx = context.WithValue(ctx, clientKey{}, clientAddr)
+
+	via, allowed := r.authorize(ctx, host, net.ParseIP(host), port)
+	if !allowed {
+		return nil, common.SocksReplyError(2)
+	}
+
+	ctx = context.WithValue(ctx, routeKey{}, via)
+
+	return r.Dial(ctx, "tcp", addr)
+}
+
+func (r *router) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := r.dial(ctx, network, addr)
+	if err != nil {
+		metrics.DialFailures.With(dialFailureReason(err)).Inc()
+
+		// Streams that failed through a tunnel are already audited
+		if errors.Is(err, errNoTunnelAlive) {
+			auditRefused(ctx, addr, "", auditNoTunnel)
+		}
+	}
+
+	return conn, err
+}
+
+func (r *router) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	via, _ := ctx.Value(routeKey{}).(string)
+
+	if via == routeDirect {
+		logger.Debugf("Connecting directly to %s", addr)
+		return net.Dial(network, addr)
+	}
+
+	if pool, prs := r.pools[via]; prs {
+		logger.Debugf("Connecting to %s via %s", addr, via)
+		return pool.Dial(ctx, network, addr)
+	}
+
+	return r.defaultPool.Dial(ctx, network, addr)
+}
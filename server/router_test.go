@@ -0,0 +1,62 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"net"
+	"testing"
+)
+
+func TestRouterAuthorize(t *testing.T) {
+	policy := &common.Policy{
+		Default: common.PolicyDeny,
+		Rules: []common.PolicyRule{
+			{DestinationMatcher: common.DestinationMatcher{Hosts: []string{"*.evil.com"}}, Action: common.PolicyDeny},
+			{DestinationMatcher: common.DestinationMatcher{Hosts: []string{"127.0.0.0/8"}, Ports: []string{"8080", "9000"}}, Action: common.PolicyAllow},
+		},
+	}
+
+	r := newRouter(newSingleTunnelPool("default", &tunnel{policy: policy}))
+	r.routes = []route{
+		{DestinationMatcher: common.DestinationMatcher{Ports: []string{"9000-9100"}}, Via: routeDirect},
+		{DestinationMatcher: common.DestinationMatcher{Hosts: []string{".blocked.test"}}, Via: routeReject},
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"address allowed", "127.0.0.1", 8080, true},
+		{"address denied", "127.0.0.1", 22, false},
+		{"name denied by name", "www.evil.com", 8080, false},
+		{"name left to the agent", "db.internal", 8080, true},
+		{"name resolved on a direct route", "localhost", 9000, true},
+		{"name denied once resolved on a direct route", "localhost", 9001, false},
+		{"rejected route", "www.blocked.test", 8080, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, allowed := r.authorize(context.Background(), test.host, net.ParseIP(test.host), test.port)
+			if allowed != test.allowed {
+				t.Errorf("authorize(%q, %d) = %t, want %t", test.host, test.port, allowed, test.allowed)
+			}
+		})
+	}
+}
@@ -15,6 +15,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/rsrdesarrollo/SaSSHimi/common"
@@ -33,44 +34,96 @@ import (
 	"time"
 )
 
+var logger = utils.NewLogger("server")
+
+var promptLock = &sync.Mutex{}
+
 type tunnel struct {
 	common.ChannelForwarder
 	sshClient      *ssh.Client
 	sshSession     *ssh.Session
 	viper          *viper.Viper
 	transparentCmd []string
+	policy         *common.Policy
+	priorities     []priorityRule
+	audits         *auditTrail
+	limits         common.RateLimits
+	limitsLock     *sync.Mutex
+	streamLimits   common.StreamLimits
+	upstream       *common.UpstreamProxy
+	dns            *common.DNSSettings
+	resolveLocally bool
+	// The agent serves HTTP, streams are opened with CONNECT
+	agentHttp      bool
+	pool           *tunnelPool
+	daemonPath     string
+	keepAgent      bool
+	manifestPath   string
+	sessionPath    string
+	sessionToken   string
+	detached       bool
+	remotePlatform platform
+	verboseLevel   int
+	closing        bool
 }
 
-func newTransparentTunnel(transparentCmd []string) *tunnel {
-	return &tunnel{
+func newTransparentTunnel(viper *viper.Viper, transparentCmd []string) *tunnel {
+	t := &tunnel{
 		ChannelForwarder: common.ChannelForwarder{
-			OutChannel: make(chan *common.DataMessage, 10),
+			OutQueue:   common.NewScheduler(),
 			InChannel:  make(chan *common.DataMessage, 10),
 
 			ChannelOpen: true,
 			ClientsLock: &sync.Mutex{},
 			Clients:     make(map[string]*common.Client),
 
-			NotifyClosure: make(chan struct{}),
+			NotifyClosure: make(chan struct{}, 1),
 		},
+		viper:          viper,
 		transparentCmd: transparentCmd,
 	}
+	t.Name = "transparent"
+	t.policy = t.getPolicy()
+	t.priorities = t.getPriorities()
+	t.audits = newAuditTrail()
+	t.limitsLock = &sync.Mutex{}
+	t.setRateLimits(t.loadRateLimits())
+	t.streamLimits = t.loadStreamLimits()
+	t.upstream = t.loadUpstream()
+	t.dns, t.resolveLocally = t.loadDNS()
+	t.agentHttp = viper.GetBool("AgentHttp")
+
+	return t
 }
 
 func newTunnel(viper *viper.Viper) *tunnel {
-	return &tunnel{
+	t := &tunnel{
 		ChannelForwarder: common.ChannelForwarder{
-			OutChannel: make(chan *common.DataMessage, 10),
+			OutQueue:   common.NewScheduler(),
 			InChannel:  make(chan *common.DataMessage, 10),
 
 			ChannelOpen: true,
 			ClientsLock: &sync.Mutex{},
 			Clients:     make(map[string]*common.Client),
 
-			NotifyClosure: make(chan struct{}),
+			NotifyClosure: make(chan struct{}, 1),
 		},
 		viper: viper,
+		// Unique per tunnel as several agents may run on the same host
+		daemonPath: "./.daemon_" + utils.RandStringRunes(10),
 	}
+	t.Name = t.getRemoteHost()
+	t.policy = t.getPolicy()
+	t.priorities = t.getPriorities()
+	t.audits = newAuditTrail()
+	t.limitsLock = &sync.Mutex{}
+	t.setRateLimits(t.loadRateLimits())
+	t.streamLimits = t.loadStreamLimits()
+	t.upstream = t.loadUpstream()
+	t.dns, t.resolveLocally = t.loadDNS()
+	t.agentHttp = viper.GetBool("AgentHttp")
+
+	return t
 }
 
 func (t *tunnel) getRemoteHost() string {
@@ -79,7 +132,7 @@ func (t *tunnel) getRemoteHost() string {
 		remoteHost = remoteHost + ":22"
 	}
 
-	utils.Logger.Debug("SSH Remote Host:", remoteHost)
+	logger.Debug("SSH Remote Host:", remoteHost)
 	return remoteHost
 }
 
@@ -89,23 +142,174 @@ func (t *tunnel) getUsername() string {
 		user, _ := user2.Current()
 		return user.Name
 	}
-	utils.Logger.Debug("SSH User:", user)
+	logger.Debug("SSH User:", user)
 	return user
 }
 
 func (t *tunnel) getRemoteExecutable() string {
 	remoteExecutable := t.viper.GetString("RemoteExecutable")
-	utils.Logger.Debug("Remote Executable:", remoteExecutable)
+	logger.Debug("Remote Executable:", remoteExecutable)
 	return remoteExecutable
 }
 
+func (t *tunnel) getPolicy() *common.Policy {
+	policyFilePath := t.viper.GetString("Policy")
+
+	if policyFilePath == "" {
+		return nil
+	}
+
+	logger.Debug("Policy File:", policyFilePath)
+
+	policy, err := loadPolicy(policyFilePath)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	return policy
+}
+
+// loadRateLimits reads the RateLimit keys of the host section.
+func (t *tunnel) loadRateLimits() common.RateLimits {
+	var limits common.RateLimits
+
+	keys := map[string]*int64{
+		"RateLimit.Upload":         &limits.Upload,
+		"RateLimit.Download":       &limits.Download,
+		"RateLimit.StreamUpload":   &limits.StreamUpload,
+		"RateLimit.StreamDownload": &limits.StreamDownload,
+	}
+
+	for key, limit := range keys {
+		rate, err := common.ParseRate(t.viper.GetString(key))
+		if err != nil {
+			logger.Fatalf("Invalid %s: %s", key, err.Error())
+		}
+		*limit = rate
+	}
+
+	return limits
+}
+
+func (t *tunnel) rateLimits() common.RateLimits {
+	t.limitsLock.Lock()
+	defer t.limitsLock.Unlock()
+
+	return t.limits
+}
+
+// setRateLimits applies the upload limits to the local clients. The download
+// ones are applied by the agent, which reads the data of the destinations,
+// when the settings are sent.
+func (t *tunnel) setRateLimits(limits common.RateLimits) {
+	t.limitsLock.Lock()
+	t.limits = limits
+	t.limitsLock.Unlock()
+
+	t.SetReadLimits(limits.Upload, limits.StreamUpload)
+}
+
+// loadStreamLimits reads the Limits keys of the host section. The agent also
+// enforces them, MaxStreams counting the streams of its tunnel only.
+func (t *tunnel) loadStreamLimits() common.StreamLimits {
+	limits := common.StreamLimits{
+		MaxStreams: t.viper.GetInt("Limits.MaxStreams"),
+	}
+
+	keys := map[string]*time.Duration{
+		"Limits.IdleTimeout": &limits.IdleTimeout,
+		"Limits.MaxLifetime": &limits.MaxLifetime,
+	}
+
+	for key, limit := range keys {
+		value := t.viper.GetString(key)
+		if value == "" {
+			continue
+		}
+
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			logger.Fatalf("Invalid %s: %s", key, err.Error())
+		}
+		*limit = duration
+	}
+
+	return limits
+}
+
+// loadUpstream reads the Upstream keys of the host section, the proxy the
+// agent dials through.
+func (t *tunnel) loadUpstream() *common.UpstreamProxy {
+	proxy := t.viper.GetString("Upstream.Proxy")
+	if proxy == "" {
+		return nil
+	}
+
+	upstream := &common.UpstreamProxy{
+		URL:     proxy,
+		NoProxy: t.viper.GetStringSlice("Upstream.NoProxy"),
+	}
+
+	if err := upstream.Validate(); err != nil {
+		logger.Fatalf("Invalid Upstream: %s", err.Error())
+	}
+
+	return upstream
+}
+
+// loadDNS returns the resolver settings of the agent, and if the names are
+// resolved here instead of by the agent.
+func (t *tunnel) loadDNS() (*common.DNSSettings, bool) {
+	var resolveLocally bool
+	switch resolve := t.viper.GetString("DNS.Resolve"); resolve {
+	case "", common.ResolveRemote:
+	case common.ResolveLocal:
+		resolveLocally = true
+	default:
+		logger.Fatalf("Invalid DNS.Resolve %s, expected %s or %s", resolve, common.ResolveRemote, common.ResolveLocal)
+	}
+
+	dns := &common.DNSSettings{
+		Servers: t.viper.GetStringSlice("DNS.Servers"),
+		Hosts:   t.viper.GetStringMapString("DNS.Hosts"),
+	}
+	if len(dns.Servers) == 0 && len(dns.Hosts) == 0 {
+		return nil, resolveLocally
+	}
+
+	if err := dns.Validate(); err != nil {
+		logger.Fatalf("Invalid DNS: %s", err.Error())
+	}
+
+	return dns, resolveLocally
+}
+
+func (t *tunnel) getAgentSettings() *common.AgentSettings {
+	limits := t.rateLimits()
+
+	return &common.AgentSettings{
+		Policy:       t.policy,
+		RateLimits:   &limits,
+		StreamLimits: &t.streamLimits,
+		Upstream:     t.upstream,
+		DNS:          t.dns,
+	}
+}
+
 func (t *tunnel) getPassword() string {
+	// Several tunnels may be opening at the same time
+	promptLock.Lock()
+	defer promptLock.Unlock()
+
 	password := t.viper.GetString("Password")
 	if password == "" {
 		fmt.Printf("%s@%s's password: ", t.getUsername(), t.getRemoteHost())
 		bytePassword, _ := terminal.ReadPassword(int(syscall.Stdin))
 		fmt.Println("")
 		password = string(bytePassword)
+
+		// Do not ask again for the other tunnels to this host
+		t.viper.Set("Password", password)
 	}
 	return password
 }
@@ -119,46 +323,18 @@ func (t *tunnel) getPublicKey() ssh.Signer {
 
 	key, err := ioutil.ReadFile(pkFilePath)
 	if err != nil {
-		utils.Logger.Fatalf("unable to read private key: %v", err)
+		logger.Fatalf("unable to read private key: %v", err)
 	}
 
 	// Create the Signer for this private key.
 	signer, err := ssh.ParsePrivateKey(key)
 	if err != nil {
-		utils.Logger.Fatalf("unable to parse private key: %v", err)
+		logger.Fatalf("unable to parse private key: %v", err)
 	}
 
 	return signer
 }
 
-func (t *tunnel) uploadForwarder() error {
-	session, err := t.sshClient.NewSession()
-	defer session.Close()
-	if err != nil {
-		return errors.New("Failed to create session: " + err.Error())
-	}
-
-	remoteExecutable := t.getRemoteExecutable()
-	var selfFilePath string
-
-	if remoteExecutable == "" {
-		selfFilePath, _ = os.Executable()
-	} else {
-		selfFilePath = remoteExecutable
-	}
-
-	selfFile, err := os.Open(selfFilePath)
-	session.Stdin = selfFile
-
-	if err != nil {
-		return errors.New("Failed to open current binary " + err.Error())
-	}
-
-	err = session.Run("cat > ./.daemon && chmod +x ./.daemon")
-
-	return err
-}
-
 func (t *tunnel) openTransparentTunnel() error {
 	var err error
 
@@ -167,13 +343,13 @@ func (t *tunnel) openTransparentTunnel() error {
 	t.Writer, _ = cmd.StdinPipe()
 	t.Reader, _ = cmd.StdoutPipe()
 
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = newAgentLogWriter(t.Name)
 
 	go t.ReadInputData()
 	go t.WriteOutputData()
 
 
-	utils.Logger.Notice("Transparent Tunnel Opening")
+	logger.Notice("Transparent Tunnel Opening")
 
 	err = cmd.Run()
 
@@ -187,7 +363,8 @@ func (t *tunnel) openTransparentTunnel() error {
 	return errors.New("Remote process is dead")
 }
 
-func (t *tunnel) openTunnel(verboseLevel int) error {
+// dial opens the SSH connection to the remote host.
+func (t *tunnel) dial() error {
 	var err error
 
 	var authMethods = []ssh.AuthMethod{}
@@ -210,50 +387,124 @@ func (t *tunnel) openTunnel(verboseLevel int) error {
 		return errors.New("Dial error: " + err.Error())
 	}
 
+	return nil
+}
+
+func (t *tunnel) openTunnel(verboseLevel int) error {
+	err := t.dial()
+	if err != nil {
+		return err
+	}
+
 	defer t.sshClient.Close()
 
-	err = t.uploadForwarder()
+	binary, checksum, err := t.readAgent()
 	if err != nil {
-		return errors.New("Failed to upload forwarder " + err.Error())
+		return err
 	}
 
-	t.sshSession, err = t.sshClient.NewSession()
-	defer t.sshSession.Close()
+	t.sessionPath, t.sessionToken = "", ""
+
+	launched := false
+	if t.useFileless() {
+		if err := t.launchFileless(binary, checksum, verboseLevel); err != nil {
+			logger.Warningf("Fileless launch not possible (%s), uploading the agent", err.Error())
+		} else {
+			launched = true
+		}
+	}
+
+	if !launched {
+		err = t.uploadForwarder(binary, checksum)
+		if err != nil {
+			return errors.New("Failed to upload forwarder " + err.Error())
+		}
 
+		if err = t.openSession(); err != nil {
+			return err
+		}
+	}
+
+	run := t.sshSession.Wait
+	if launched {
+		if t.getPersist() > 0 {
+			logger.Warning("A fileless agent cannot persist, the streams will not survive the connection")
+		}
+	} else {
+		command := logEnv() + " " + shellQuote(t.daemonPath) + " " + t.agentArguments(verboseLevel)
+		run = func() error {
+			return t.sshSession.Run(command)
+		}
+	}
+
+	if t.sessionToken != "" {
+		t.EnableResume()
+	}
+
+	logger.Notice("SSH Tunnel Open")
+
+	for lost := t.serveSession(run); lost && !t.closing; {
+		lost = t.reattach()
+	}
+
+	t.ChannelOpen = false
+	t.NotifyClosure <- struct{}{}
+
+	return errors.New("Remote process is dead")
+}
+
+// openSession creates the session of the agent with its standard streams.
+func (t *tunnel) openSession() error {
+	var err error
+
+	t.sshSession, err = t.sshClient.NewSession()
 	if err != nil {
 		return errors.New("Failed to create session: " + err.Error())
 	}
 
 	t.Writer, err = t.sshSession.StdinPipe()
 	if err != nil {
+		t.sshSession.Close()
 		return errors.New("Failed to pipe STDIN on session: " + err.Error())
 	}
 
 	t.Reader, err = t.sshSession.StdoutPipe()
 	if err != nil {
+		t.sshSession.Close()
 		return errors.New("Failed to pipe STDOUT on session: " + err.Error())
 	}
 
-	t.sshSession.Stderr = os.Stderr
-
-	go t.ReadInputData()
-	go t.WriteOutputData()
+	t.sshSession.Stderr = newAgentLogWriter(t.Name)
 
-	utils.Logger.Notice("SSH Tunnel Open")
+	return nil
+}
 
-	var runCommand = "./.daemon agent %s"
-	var commandOps = ""
+// agentArguments returns the agent command with its options.
+func (t *tunnel) agentArguments(verboseLevel int) string {
+	arguments := "agent"
 
 	if verboseLevel != 0 {
-		commandOps = "-" + strings.Repeat("v", verboseLevel)
+		arguments += " -" + strings.Repeat("v", verboseLevel)
 	}
 
-	t.sshSession.Run(fmt.Sprintf(runCommand, commandOps))
+	if t.agentHttp {
+		arguments += " --use-http"
+	}
 
-	t.ChannelOpen = false
-	t.NotifyClosure <- struct{}{}
+	// A cached agent is reused by the next connections
+	if t.keepAgent {
+		arguments += " --keep-binary"
+	}
 
-	return errors.New("Remote process is dead")
+	if t.manifestPath != "" {
+		arguments += " --manifest " + shellQuote(t.manifestPath)
+	}
+
+	if t.sessionToken != "" {
+		arguments += " --persist " + t.getPersist().String() + " --session " + shellQuote(t.sessionPath)
+	}
+
+	return arguments
 }
 
 func (t *tunnel) handleClients() {
@@ -264,146 +515,374 @@ func (t *tunnel) handleClients() {
 			continue
 		}
 
-		t.ClientsLock.Lock()
+		if msg.KeepAliveAck {
+			t.UpdateRTT(msg)
+			continue
+		}
 
+		// Writes may block on slow clients, keep the lock only for the registry
+		t.ClientsLock.Lock()
 		client, prs := t.Clients[msg.ClientId]
+		if prs && (msg.DeadClient || msg.CloseClient) {
+			delete(t.Clients, msg.ClientId)
+		}
+		t.ClientsLock.Unlock()
 
 		if prs == false {
-			utils.Logger.Warning("Received data from closed client", msg.ClientId)
+			logger.Warning("Received data from closed client", msg.ClientId)
 		} else {
 			if msg.DeadClient {
 				// ACK for client termination
 				client.NotifyEOF(false)
 				client.Terminate()
-				delete(t.Clients, msg.ClientId)
+				t.removeClient(client, auditRemoteError)
 			} else if msg.CloseClient {
-				client.Close()
-				delete(t.Clients, msg.ClientId)
+				// ACK for a stream terminated here, its reason is already set
+				t.removeClient(client, auditKilled)
+			} else if msg.HalfClose {
+				// Fully closed now if the local client had finished first
+				if client.CloseWrite() {
+					t.removeClient(client, auditClientClosed)
+				}
 			} else if !client.IsDead() {
 				err := client.Write(msg.Data)
 
-				if err != nil {
+				// Clients killed meanwhile have already notified their peer
+				if err != nil && !client.IsDead() {
+					t.audits.reason(client.Id, "write error: "+err.Error())
 					client.Terminate()
 					client.NotifyEOF(true)
 
-					utils.Logger.Errorf("Error Writing: %s\n", err.Error())
+					t.streamLogger(client).Errorf("Error Writing: %s", err.Error())
 				}
 
 			}
 		}
+	}
+}
 
-		t.ClientsLock.Unlock()
+// removeClient forgets a closed stream and writes its audit record.
+func (t *tunnel) removeClient(client *common.Client, reason string) {
+	t.ClientsLock.Lock()
+	if t.Clients[client.Id] == client {
+		delete(t.Clients, client.Id)
 	}
+	t.ClientsLock.Unlock()
+
+	t.audits.end(client, reason)
+	t.streamLogger(client).Infof("Stream closed (sent %d, received %d bytes)", client.BytesSent(), client.BytesReceived())
 }
 
-func RunTransparent(transparentCmd []string, bindAddress string) {
-	ln, err := net.Listen("tcp", bindAddress)
+// killClient terminates a stream on both ends of the tunnel.
+func (t *tunnel) killClient(clientId string) bool {
+	return t.terminateClient(clientId, auditKilled)
+}
 
-	if err != nil {
-		panic("Failed to bind local port " + err.Error())
+// terminateClient closes a stream on both ends, recording reason in its
+// audit record.
+func (t *tunnel) terminateClient(clientId string, reason string) bool {
+	t.ClientsLock.Lock()
+	defer t.ClientsLock.Unlock()
+
+	client, prs := t.Clients[clientId]
+	if !prs || client.IsDead() {
+		return false
 	}
 
-	utils.Logger.Notice("Proxy bind at", bindAddress)
+	t.streamLogger(client).Infof("Terminating stream: %s", reason)
+	t.audits.reason(clientId, reason)
 
-	tunnel := newTransparentTunnel(transparentCmd)
+	client.Terminate()
+	client.NotifyEOF(true)
 
-	go func() {
-		err = tunnel.openTransparentTunnel()
+	return true
+}
 
-		if err != nil {
-			utils.Logger.Fatal("Failed to open tunnel ", err.Error())
+// expireClients closes, while the channel is open, the streams idle or open
+// for longer than the limits.
+func (t *tunnel) expireClients() {
+	for t.ChannelOpen {
+		time.Sleep(1 * time.Second)
+
+		for client, reason := range t.ExpiredClients(t.streamLimits) {
+			t.terminateClient(client.Id, reason)
 		}
-	}()
+	}
+}
 
-	go tunnel.handleClients()
-	go tunnel.KeepAlive()
+// streamLogger logs about a stream of the tunnel.
+func (t *tunnel) streamLogger(client *common.Client) *utils.FieldLogger {
+	fields := client.LogFields()
+	fields["tunnel"] = t.Name
 
-	for tunnel.ChannelOpen {
-		conn, err := ln.Accept()
+	return utils.WithFields(logger, fields)
+}
+
+func (t *tunnel) streams() int {
+	t.ClientsLock.Lock()
+	defer t.ClientsLock.Unlock()
+
+	return len(t.Clients)
+}
+
+// Dial opens a new stream through the tunnel to the remote proxy and asks it
+// to connect to addr. It is used as the dialer of the local SOCKS server.
+func (t *tunnel) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	local, remote := common.Pipe()
+
+	t.ClientsLock.Lock()
+
+	clientId, _ := ctx.Value(clientKey{}).(string)
+	if _, prs := t.Clients[clientId]; prs || clientId == "" || clientId == "@" {
+		clientId = clientId + "#" + utils.RandStringRunes(6)
+	}
+
+	client := common.NewClient(
+		clientId,
+		remote,
+		t.OutQueue,
+	)
+	client.Destination = addr
+	client.Priority = t.priorityOf(addr)
+
+	t.LimitClient(client)
+	t.Clients[client.Id] = client
+	t.ClientsLock.Unlock()
+
+	t.audits.start(ctx, t.Name, client)
+
+	go func() {
+		// Fully closed now if the remote end had finished first
+		if client.ReadFromClientToChannel() {
+			t.removeClient(client, auditRemoteClosed)
+		}
+	}()
+
+	// The client keeps the name as destination
+	if t.resolveLocally {
+		resolved, err := common.NewResolver(nil).ResolveAddr(ctx, addr)
 		if err != nil {
-			utils.Logger.Fatalf("Error in conncetion accept: %s", err.Error())
-			continue
+			t.streamLogger(client).Debugf("Failed to resolve the destination: %s", err.Error())
+			t.audits.reason(client.Id, "resolve failed: "+err.Error())
+			local.Close()
+			return nil, err
 		}
+		addr = resolved
+	}
 
-		utils.Logger.Debug("New connection from ", conn.RemoteAddr().String())
+	conn, err := t.connectAgent(local, addr)
+	if err != nil {
+		t.streamLogger(client).Debugf("Remote proxy failed to connect: %s", err.Error())
+		t.audits.reason(client.Id, "connect failed: "+err.Error())
+		local.Close()
+		return nil, err
+	}
 
-		client := common.NewClient(
-			conn.RemoteAddr().String(),
-			conn,
-			tunnel.OutChannel,
-		)
+	t.audits.connected(client)
+	captureStream(ctx, client)
 
-		tunnel.Clients[client.Id] = client
-		go client.ReadFromClientToChannel()
-	}
+	t.streamLogger(client).Infof("Stream opened")
+
+	return conn, nil
 }
 
-func Run(viper *viper.Viper, bindAddress string, verboseLevel int) {
+// connectAgent asks the proxy of the agent, over the local end of a new
+// stream, to connect to addr.
+func (t *tunnel) connectAgent(local *common.PipeConn, addr string) (net.Conn, error) {
+	if t.agentHttp {
+		// CONNECT does not tell the bound address
+		unknown := &net.TCPAddr{IP: net.IPv4zero}
+		local.SetAddrs(unknown, unknown)
 
-	ln, err := net.Listen("tcp", bindAddress)
+		return common.HttpConnect(local, addr, nil)
+	}
 
+	bound, err := common.SocksConnect(local, addr, nil)
 	if err != nil {
-		panic("Failed to bind local port " + err.Error())
+		return nil, err
 	}
 
-	utils.Logger.Notice("Proxy bind at", bindAddress)
+	local.SetAddrs(bound, bound)
 
-	tunnel := newTunnel(viper)
+	return local, nil
+}
 
-	termios := TermiosSaveStdin()
-	onExit := func() {
-		TermiosRestoreStdin(termios)
-		tunnel.Terminate()
-
-		utils.Logger.Notice("Waiting to remote process to clean up...")
-		select {
-		case <-tunnel.NotifyClosure:
-		case <-time.After(5 * time.Second):
-			tunnel.sshSession.Signal(ssh.SIGTERM)
-			utils.Logger.Warning("Remote close timeout. Sending TERM signal.")
+// start opens the SSH tunnel and serves its clients in background.
+func (t *tunnel) start(verboseLevel int) {
+	t.verboseLevel = verboseLevel
+	t.SendSettings(t.getAgentSettings())
+
+	go func() {
+		err := t.openTunnel(verboseLevel)
+		t.Close()
+		t.auditRemaining()
+
+		if err == nil || t.closing {
+			return
 		}
 
-		select {
-		case <-tunnel.NotifyClosure:
-		case <-time.After(5 * time.Second):
-			utils.Logger.Error("Remote process don't respond. Force close channel.")
-			utils.Logger.Error("IMPORTANT: This might leave files in remote host.")
-			tunnel.sshSession.Close()
+		if len(t.pool.alive()) == 0 {
+			logger.Fatal("Failed to open tunnel ", err.Error())
 		}
 
-		tunnel.sshClient.Close()
-		ln.Close()
+		logger.Errorf("Tunnel to %s failed: %s. New connections will use the remaining tunnels of %s",
+			t.getRemoteHost(), err.Error(), t.pool.name)
+	}()
+
+	go t.handleClients()
+	go t.KeepAlive()
+	go t.expireClients()
+}
+
+// shutdown asks the remote agent to finish and waits for it to clean up.
+func (t *tunnel) shutdown() {
+	t.closing = true
+	defer t.auditRemaining()
+
+	if t.detached {
+		logger.Warningf("The agent of %s is detached, it exits by itself after %s", t.Name, t.getPersist())
+		return
 	}
 
-	utils.ExitCallback(onExit)
+	if !t.ChannelOpen {
+		// Nothing running on the remote side
+		if t.sshClient != nil {
+			t.sshClient.Close()
+		}
+		return
+	}
+
+	t.Terminate()
+
+	defer t.sshClient.Close()
+
+	logger.Notice("Waiting to remote process to clean up...")
+	select {
+	case <-t.NotifyClosure:
+		return
+	case <-time.After(5 * time.Second):
+		t.sshSession.Signal(ssh.SIGTERM)
+		logger.Warning("Remote close timeout. Sending TERM signal.")
+	}
+
+	select {
+	case <-t.NotifyClosure:
+	case <-time.After(5 * time.Second):
+		logger.Error("Remote process don't respond. Force close channel.")
+		logger.Errorf("IMPORTANT: This might leave files in remote host, remove them with: SaSSHimi cleanup %s", t.viper.GetString("RemoteHost"))
+		t.sshSession.Close()
+	}
+}
+
+func RunTransparent(viper *viper.Viper, transparentCmd []string, bindAddresses []string) {
+	listeners := loadListeners(viper, bindAddresses)
+	openAudit(viper)
+	openCapture(viper)
+
+	tunnel := newTransparentTunnel(viper, transparentCmd)
+	tunnel.SendSettings(tunnel.getAgentSettings())
 
 	go func() {
-		err = tunnel.openTunnel(verboseLevel)
+		err := tunnel.openTransparentTunnel()
+		tunnel.auditRemaining()
+		audit.Close()
+		closeCapture()
 
 		if err != nil {
-			utils.Logger.Fatal("Failed to open tunnel ", err.Error())
+			logger.Fatal("Failed to open tunnel ", err.Error())
 		}
 	}()
 
 	go tunnel.handleClients()
 	go tunnel.KeepAlive()
+	go tunnel.expireClients()
+
+	router := newRouter(newSingleTunnelPool("transparent", tunnel))
+	router.limiter = newConnLimiter(viper)
+
+	utils.ExitCallback(func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	})
+
+	for _, l := range listeners {
+		go l.serve(router)
+	}
+
+	if metricsAddress := viper.GetString("MetricsListen"); metricsAddress != "" {
+		serveMetrics(metricsAddress, router)
+	}
 
 	for tunnel.ChannelOpen {
-		conn, err := ln.Accept()
-		if err != nil {
-			utils.Logger.Fatalf("Error in conncetion accept: %s", err.Error())
-			continue
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func Run(viper *viper.Viper, bindAddresses []string, verboseLevel int) {
+	listeners := loadListeners(viper, bindAddresses)
+	openAudit(viper)
+	openCapture(viper)
+
+	router := newRouter(newTunnelPool("default", viper))
+	router.loadRoutes(viper)
+	router.limiter = newConnLimiter(viper)
+
+	exiting := false
+	var control *controller
+	var dash *dashboard
+
+	termios := TermiosSaveStdin()
+	onExit := func() {
+		exiting = true
+		if dash != nil {
+			dash.Close()
 		}
+		TermiosRestoreStdin(termios)
 
-		utils.Logger.Debug("New connection from ", conn.RemoteAddr().String())
+		wg := &sync.WaitGroup{}
+		for _, t := range router.allTunnels() {
+			wg.Add(1)
+			go func(t *tunnel) {
+				defer wg.Done()
+				t.shutdown()
+			}(t)
+		}
+		wg.Wait()
+		audit.Close()
+		closeCapture()
+
+		if control != nil {
+			control.Close()
+		}
+	}
+
+	utils.ExitCallback(onExit)
+
+	for _, t := range router.allTunnels() {
+		t.start(verboseLevel)
+	}
+
+	control = newController(router, listeners)
+
+	if controlSocket := viper.GetString("ControlSocket"); controlSocket != "" {
+		control.listen(controlSocket)
+	}
 
-		client := common.NewClient(
-			conn.RemoteAddr().String(),
-			conn,
-			tunnel.OutChannel,
-		)
+	if metricsAddress := viper.GetString("MetricsListen"); metricsAddress != "" {
+		serveMetrics(metricsAddress, router)
+	}
+
+	if viper.GetBool("Dashboard") {
+		dash = newDashboard(control, func() {
+			onExit()
+			os.Exit(0)
+		})
+		go dash.run()
+	}
 
-		tunnel.Clients[client.Id] = client
-		go client.ReadFromClientToChannel()
+	// Keep running while the exit callback cleans up
+	for exiting || len(router.defaultPool.alive()) > 0 {
+		time.Sleep(1 * time.Second)
 	}
 }
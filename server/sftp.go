@@ -0,0 +1,267 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+)
+
+// The few SFTP version 3 packets needed to write a file
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpWrite   = 6
+	sftpSetstat = 9
+	sftpStatus  = 101
+	sftpHandle  = 102
+
+	sftpFlagWrite  = 0x02
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+
+	sftpAttrPermissions = 0x04
+
+	// Data per write, below the 32KB every server must accept
+	sftpChunkSize = 32000
+)
+
+// sftpSession is a minimal SFTP client, one request at a time.
+type sftpSession struct {
+	session *ssh.Session
+	in      io.WriteCloser
+	out     io.Reader
+	id      uint32
+}
+
+// uploadWithSftp writes the binary through the SFTP subsystem, which works
+// even without a shell.
+func uploadWithSftp(client *ssh.Client, file io.Reader, size int64, remotePath string) error {
+	s, err := newSftpSession(client)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	handle, err := s.open(remotePath)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, sftpChunkSize)
+	var offset uint64
+	for {
+		n, readErr := io.ReadFull(file, chunk)
+		if n > 0 {
+			if err := s.write(handle, offset, chunk[:n]); err != nil {
+				return err
+			}
+			offset += uint64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	if err := s.close(handle); err != nil {
+		return err
+	}
+
+	// Permissions given on open are masked by the umask
+	return s.chmod(remotePath, 0755)
+}
+
+func newSftpSession(client *ssh.Client) (*sftpSession, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, errors.New("Failed to create session: " + err.Error())
+	}
+
+	s := &sftpSession{session: session}
+
+	if s.in, err = session.StdinPipe(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	if s.out, err = session.StdoutPipe(); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, errors.New("sftp subsystem not available: " + err.Error())
+	}
+
+	// The init packet has a version instead of a request id
+	if err := s.send(sftpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	packetType, _, err := s.receive()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if packetType != sftpVersion {
+		s.Close()
+		return nil, fmt.Errorf("unexpected sftp packet %d", packetType)
+	}
+
+	return s, nil
+}
+
+func (s *sftpSession) Close() error {
+	s.in.Close()
+	return s.session.Close()
+}
+
+func (s *sftpSession) send(packetType byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+	packet = append(packet, packetType)
+	packet = append(packet, payload...)
+
+	_, err := s.in.Write(packet)
+	return err
+}
+
+func (s *sftpSession) receive() (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(s.out, header); err != nil {
+		return 0, nil, errors.New("sftp closed: " + err.Error())
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length < 1 || length > 256*1024 {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", length)
+	}
+
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(s.out, payload); err != nil {
+		return 0, nil, errors.New("sftp closed: " + err.Error())
+	}
+
+	return header[4], payload, nil
+}
+
+// request sends a packet with a new id and returns the type and payload,
+// after the id, of its response.
+func (s *sftpSession) request(packetType byte, payload []byte) (byte, []byte, error) {
+	s.id++
+	packet := binary.BigEndian.AppendUint32(nil, s.id)
+
+	if err := s.send(packetType, append(packet, payload...)); err != nil {
+		return 0, nil, err
+	}
+
+	responseType, response, err := s.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(response) < 4 || binary.BigEndian.Uint32(response) != s.id {
+		return 0, nil, errors.New("unexpected sftp response")
+	}
+
+	return responseType, response[4:], nil
+}
+
+// status checks that a response is a successful status.
+func (s *sftpSession) status(responseType byte, response []byte) error {
+	if responseType != sftpStatus || len(response) < 4 {
+		return fmt.Errorf("unexpected sftp packet %d", responseType)
+	}
+
+	code := binary.BigEndian.Uint32(response)
+	if code == 0 {
+		return nil
+	}
+
+	message := ""
+	if len(response) >= 8 {
+		length := int(binary.BigEndian.Uint32(response[4:]))
+		if 8+length <= len(response) {
+			message = string(response[8 : 8+length])
+		}
+	}
+
+	return fmt.Errorf("sftp error %d: %s", code, message)
+}
+
+func (s *sftpSession) open(path string) ([]byte, error) {
+	payload := appendSftpString(nil, []byte(path))
+	payload = binary.BigEndian.AppendUint32(payload, sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc)
+	payload = binary.BigEndian.AppendUint32(payload, sftpAttrPermissions)
+	payload = binary.BigEndian.AppendUint32(payload, 0700)
+
+	responseType, response, err := s.request(sftpOpen, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if responseType != sftpHandle {
+		return nil, s.status(responseType, response)
+	}
+	if len(response) < 4 || 4+int(binary.BigEndian.Uint32(response)) > len(response) {
+		return nil, errors.New("invalid sftp handle")
+	}
+
+	return response[4 : 4+binary.BigEndian.Uint32(response)], nil
+}
+
+func (s *sftpSession) write(handle []byte, offset uint64, data []byte) error {
+	payload := appendSftpString(nil, handle)
+	payload = binary.BigEndian.AppendUint64(payload, offset)
+	payload = appendSftpString(payload, data)
+
+	responseType, response, err := s.request(sftpWrite, payload)
+	if err != nil {
+		return err
+	}
+	return s.status(responseType, response)
+}
+
+func (s *sftpSession) close(handle []byte) error {
+	responseType, response, err := s.request(sftpClose, appendSftpString(nil, handle))
+	if err != nil {
+		return err
+	}
+	return s.status(responseType, response)
+}
+
+func (s *sftpSession) chmod(path string, mode uint32) error {
+	payload := appendSftpString(nil, []byte(path))
+	payload = binary.BigEndian.AppendUint32(payload, sftpAttrPermissions)
+	payload = binary.BigEndian.AppendUint32(payload, mode)
+
+	responseType, response, err := s.request(sftpSetstat, payload)
+	if err != nil {
+		return err
+	}
+	return s.status(responseType, response)
+}
+
+func appendSftpString(buffer []byte, data []byte) []byte {
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(data)))
+	return append(buffer, data...)
+}
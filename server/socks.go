@@ -0,0 +1,237 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// serveSocks handles a SOCKS5 client. Only CONNECT is supported, with the
+// username and password authentication of RFC 1929 if the listener has
+// Users. Failed connections are replied with their SOCKS code, so streams
+// refused by the policy of the agent are not allowed by the ruleset too.
+func (l *listener) serveSocks(conn net.Conn, r *router) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	user, err := l.socksHandshake(conn, reader)
+	if err != nil {
+		logger.Debugf("SOCKS handshake with %s failed: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	target, err := readSocksRequest(reader)
+	if err != nil {
+		logger.Debugf("Invalid SOCKS request from %s: %s", conn.RemoteAddr().String(), err.Error())
+
+		var replyErr common.SocksReplyError
+		if errors.As(err, &replyErr) {
+			writeSocksReply(conn, byte(replyErr), nil)
+		}
+		return
+	}
+
+	ctx := context.Background()
+	if user != "" {
+		ctx = context.WithValue(ctx, userKey{}, user)
+	}
+
+	remote, err := r.connect(ctx, conn.RemoteAddr().String(), target)
+	if err != nil {
+		writeSocksReply(conn, socksReplyCode(err), nil)
+		return
+	}
+	defer remote.Close()
+
+	if err := writeSocksReply(conn, 0, remote.LocalAddr()); err != nil {
+		return
+	}
+
+	splice(conn, reader, remote)
+}
+
+// socksHandshake negotiates the authentication method with the client and
+// checks its credentials, returning the authenticated user if any.
+func (l *listener) socksHandshake(conn net.Conn, reader *bufio.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+
+	if header[0] != 5 {
+		return "", errors.New("unsupported SOCKS version " + strconv.Itoa(int(header[0])))
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+
+	// No authentication, or username and password if there are users
+	method := byte(0)
+	if len(l.Users) > 0 {
+		method = 2
+	}
+
+	if bytes.IndexByte(methods, method) < 0 {
+		conn.Write([]byte{5, 0xff})
+		return "", errors.New("no acceptable authentication method")
+	}
+
+	if _, err := conn.Write([]byte{5, method}); err != nil {
+		return "", err
+	}
+
+	if method == 0 {
+		return "", nil
+	}
+
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	user, err := readSocksString(reader)
+	if err != nil {
+		return "", err
+	}
+
+	password, err := readSocksString(reader)
+	if err != nil {
+		return "", err
+	}
+
+	expected, prs := l.Users[user]
+	if version != 1 || !prs || expected != password {
+		logger.Warningf("Unauthorized SOCKS client %s", conn.RemoteAddr().String())
+		conn.Write([]byte{1, 1})
+		return "", errors.New("authentication failed")
+	}
+
+	_, err = conn.Write([]byte{1, 0})
+
+	return user, err
+}
+
+// readSocksRequest reads a CONNECT request and returns its destination as
+// host:port. Other commands and address types fail with their SOCKS reply.
+func readSocksRequest(reader *bufio.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+
+	if header[0] != 5 {
+		return "", errors.New("unsupported SOCKS version " + strconv.Itoa(int(header[0])))
+	}
+
+	var host string
+	switch header[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if header[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		name, err := readSocksString(reader)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		return "", common.SocksReplyError(8)
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+
+	if header[1] != 1 {
+		return "", common.SocksReplyError(7)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func readSocksString(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// writeSocksReply sends a reply with the address bound for the client, if
+// known.
+func writeSocksReply(conn net.Conn, code byte, bound net.Addr) error {
+	addr, ok := bound.(*net.TCPAddr)
+	if !ok {
+		addr = &net.TCPAddr{IP: net.IPv4zero}
+	}
+
+	reply := []byte{5, code, 0}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		reply = append(append(reply, 1), ip4...)
+	} else if ip6 := addr.IP.To16(); ip6 != nil {
+		reply = append(append(reply, 4), ip6...)
+	} else {
+		reply = append(reply, 1, 0, 0, 0, 0)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(addr.Port))
+
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socksReplyCode returns the SOCKS reply of a failed connection, the one of
+// the agent if it replied.
+func socksReplyCode(err error) byte {
+	var replyErr common.SocksReplyError
+
+	switch {
+	case errors.As(err, &replyErr):
+		return byte(replyErr)
+	case errors.Is(err, errNoTunnelAlive):
+		return 1
+	case errors.Is(err, syscall.ENETUNREACH) || strings.Contains(err.Error(), "network is unreachable"):
+		return 3
+	case errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(err.Error(), "refused"):
+		return 5
+	}
+
+	return 4
+}
@@ -0,0 +1,129 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+func TestServeSocks(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	r := newRouter(newSingleTunnelPool("default", &tunnel{policy: &common.Policy{Default: common.PolicyAllow}}))
+	r.routes = []route{
+		{DestinationMatcher: common.DestinationMatcher{Hosts: []string{".blocked.test"}}, Via: routeReject},
+		{Via: routeDirect},
+	}
+
+	l := &listener{listenerConfig: listenerConfig{Users: map[string]string{"user": "secret"}}}
+
+	// reply is the SOCKS reply expected, or -1 if the handshake fails
+	tests := []struct {
+		name  string
+		addr  string
+		user  *url.Userinfo
+		reply int
+	}{
+		{"connected", echo.Addr().String(), url.UserPassword("user", "secret"), 0},
+		{"rejected", "www.blocked.test:80", url.UserPassword("user", "secret"), 2},
+		{"refused", closedAddr, url.UserPassword("user", "secret"), 5},
+		{"wrong password", echo.Addr().String(), url.UserPassword("user", "wrong"), -1},
+		{"no credentials", echo.Addr().String(), nil, -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			go l.serveSocks(server, r)
+
+			_, err := common.SocksConnect(client, test.addr, test.user)
+			if test.reply == 0 {
+				if err != nil {
+					t.Fatalf("SocksConnect(%s) failed: %s", test.addr, err)
+				}
+
+				if _, err := client.Write([]byte("ping")); err != nil {
+					t.Fatal(err)
+				}
+				data := make([]byte, 4)
+				if _, err := io.ReadFull(client, data); err != nil || string(data) != "ping" {
+					t.Errorf("echo = %q, %v, want \"ping\"", data, err)
+				}
+				return
+			}
+
+			if test.reply > 0 {
+				if err != common.SocksReplyError(test.reply) {
+					t.Errorf("SocksConnect(%s) = %v, want %v", test.addr, err, common.SocksReplyError(test.reply))
+				}
+			} else if err == nil {
+				t.Errorf("SocksConnect(%s) succeeded, want an error", test.addr)
+			}
+		})
+	}
+}
+
+func TestSocksReplyCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code byte
+	}{
+		{common.SocksReplyError(2), 2},
+		{fmt.Errorf("dial via agent: %w", common.SocksReplyError(6)), 6},
+		{errNoTunnelAlive, 1},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, 5},
+		{&net.OpError{Op: "dial", Err: syscall.ENETUNREACH}, 3},
+		{errors.New("i/o timeout"), 4},
+	}
+
+	for _, test := range tests {
+		if code := socksReplyCode(test.err); code != test.code {
+			t.Errorf("socksReplyCode(%v) = %d, want %d", test.err, code, test.code)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package server
+
+import "golang.org/x/sys/unix"
+
+// rawTermios returns termios in raw mode, as cfmakeraw does.
+func rawTermios(termios unix.Termios) *unix.Termios {
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+
+	return &termios
+}
@@ -1,18 +1,39 @@
-//go:build !windows && !darwin
+//go:build !windows
 
 package server
 
 import (
+	"os"
+	"os/signal"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
 func TermiosSaveStdin() *unix.Termios {
-	termios, _ := unix.IoctlGetTermios(int(syscall.Stdin), unix.TCGETS)
+	termios, _ := unix.IoctlGetTermios(int(syscall.Stdin), ioctlGetTermios)
 	return termios
 }
 
 func TermiosRestoreStdin(value *unix.Termios) {
-	unix.IoctlSetTermios(int(syscall.Stdin), unix.TCGETS, value)
+	if value == nil {
+		return
+	}
+	unix.IoctlSetTermios(int(syscall.Stdin), ioctlSetTermios, value)
+}
+
+// TermiosMakeRawStdin puts the terminal of stdin in raw mode, to be restored
+// with the state saved before.
+func TermiosMakeRawStdin() error {
+	termios, err := unix.IoctlGetTermios(int(syscall.Stdin), ioctlGetTermios)
+	if err != nil {
+		return err
+	}
+
+	return unix.IoctlSetTermios(int(syscall.Stdin), ioctlSetTermios, rawTermios(*termios))
+}
+
+// NotifyWindowResize relays to c the changes of size of the terminal.
+func NotifyWindowResize(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGWINCH)
 }
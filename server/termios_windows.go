@@ -2,9 +2,21 @@
 
 package server
 
+import (
+	"errors"
+	"os"
+)
+
 func TermiosSaveStdin() int {
 	return 0
 }
 
 func TermiosRestoreStdin(value int) {
 }
+
+func TermiosMakeRawStdin() error {
+	return errors.New("raw mode is not supported on windows")
+}
+
+func NotifyWindowResize(c chan<- os.Signal) {
+}
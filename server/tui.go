@@ -0,0 +1,408 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"github.com/op/go-logging"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	dashboardRefresh  = 1 * time.Second
+	sparklineWidth    = 20
+	dashboardLogLines = 6
+)
+
+var sparklineTicks = []rune("▁▂▃▄▅▆▇█")
+
+var dashboardLevels = []logging.Level{logging.NOTICE, logging.INFO, logging.DEBUG}
+
+// logRing keeps the last lines written to it, so the log can be shown in the
+// dashboard instead of breaking the screen.
+type logRing struct {
+	lines []string
+	size  int
+	lock  *sync.Mutex
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		r.lines = append(r.lines, line)
+	}
+	if len(r.lines) > r.size {
+		r.lines = r.lines[len(r.lines)-r.size:]
+	}
+
+	return len(p), nil
+}
+
+func (r *logRing) last() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]string{}, r.lines...)
+}
+
+// dashboard is a full screen view of the tunnels and their streams, fed by
+// the client registry of every tunnel.
+type dashboard struct {
+	control    *controller
+	logs       *logRing
+	history    map[string][]uint64
+	lastBytes  map[string]uint64
+	selected   int
+	termState  *terminal.State
+	restoreLog func()
+	quit       func()
+	closed     bool
+	lock       *sync.Mutex
+}
+
+func newDashboard(control *controller, quit func()) *dashboard {
+	return &dashboard{
+		control:   control,
+		logs:      &logRing{size: dashboardLogLines, lock: &sync.Mutex{}},
+		history:   make(map[string][]uint64),
+		lastBytes: make(map[string]uint64),
+		quit:      quit,
+		lock:      &sync.Mutex{},
+	}
+}
+
+func (d *dashboard) run() {
+	// Tunnels may still be prompting for passwords
+	for !d.tunnelsReady() {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	termState, err := terminal.MakeRaw(int(syscall.Stdin))
+	if err != nil {
+		logger.Error("Unable to start dashboard: " + err.Error())
+		return
+	}
+
+	d.lock.Lock()
+	d.termState = termState
+	d.restoreLog = utils.RedirectLog(d.logs)
+	d.lock.Unlock()
+
+	// Alternate screen, hidden cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+
+	go d.readKeys()
+
+	for {
+		d.lock.Lock()
+		if d.closed {
+			d.lock.Unlock()
+			return
+		}
+		d.sample()
+		d.draw()
+		d.lock.Unlock()
+
+		time.Sleep(dashboardRefresh)
+	}
+}
+
+func (d *dashboard) tunnelsReady() bool {
+	for _, t := range d.control.tunnels() {
+		if t.Alive && t.RTT == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Close restores the terminal and the log output.
+func (d *dashboard) Close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed || d.termState == nil {
+		d.closed = true
+		return
+	}
+	d.closed = true
+
+	fmt.Print("\x1b[?25h\x1b[?1049l")
+	terminal.Restore(int(syscall.Stdin), d.termState)
+	d.restoreLog()
+}
+
+func (d *dashboard) readKeys() {
+	buf := make([]byte, 32)
+
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+
+		keys := buf[:n]
+		for len(keys) > 0 {
+			switch {
+			case strings.HasPrefix(string(keys), "\x1b[A"):
+				d.moveSelection(-1)
+				keys = keys[3:]
+				continue
+			case strings.HasPrefix(string(keys), "\x1b[B"):
+				d.moveSelection(1)
+				keys = keys[3:]
+				continue
+			}
+
+			switch keys[0] {
+			case 'k':
+				d.moveSelection(-1)
+			case 'j':
+				d.moveSelection(1)
+			case 'x', 'd':
+				d.killSelected()
+			case 'v':
+				d.toggleVerbosity()
+			case 'q', 3:
+				go d.quit()
+				return
+			}
+			keys = keys[1:]
+		}
+	}
+}
+
+func (d *dashboard) moveSelection(delta int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.selected += delta
+	d.draw()
+}
+
+func (d *dashboard) killSelected() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	clients := d.control.clients()
+	if d.selected < len(clients) {
+		d.control.killClient(clients[d.selected].Id)
+	}
+	d.draw()
+}
+
+func (d *dashboard) toggleVerbosity() {
+	current := utils.GetLogLevel("")
+
+	next := dashboardLevels[0]
+	for i, level := range dashboardLevels {
+		if level == current && i+1 < len(dashboardLevels) {
+			next = dashboardLevels[i+1]
+		}
+	}
+
+	utils.SetLogLevel(next, "")
+	logger.Notice("Log level set to", next.String())
+
+	d.lock.Lock()
+	d.draw()
+	d.lock.Unlock()
+}
+
+// sample records the bytes moved by every stream since the last refresh.
+func (d *dashboard) sample() {
+	seen := make(map[string]bool)
+
+	for _, c := range d.control.clients() {
+		seen[c.Id] = true
+
+		total := c.BytesSent + c.BytesReceived
+		history := append(d.history[c.Id], total-d.lastBytes[c.Id])
+		if len(history) > sparklineWidth {
+			history = history[len(history)-sparklineWidth:]
+		}
+
+		d.history[c.Id] = history
+		d.lastBytes[c.Id] = total
+	}
+
+	for id := range d.history {
+		if !seen[id] {
+			delete(d.history, id)
+			delete(d.lastBytes, id)
+		}
+	}
+}
+
+func (d *dashboard) draw() {
+	if d.closed {
+		return
+	}
+
+	width, height, err := terminal.GetSize(int(syscall.Stdout))
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	tunnels := d.control.tunnels()
+	clients := d.control.clients()
+
+	if d.selected >= len(clients) {
+		d.selected = len(clients) - 1
+	}
+	if d.selected < 0 {
+		d.selected = 0
+	}
+
+	var lines []string
+	lines = append(lines,
+		fmt.Sprintf("\x1b[1mSaSSHimi\x1b[0m  %d tunnels  %d streams  log %s    [↑↓] select  [x] kill  [v] verbosity  [q] quit",
+			len(tunnels), len(clients), utils.GetLogLevel("").String()),
+		"",
+		"\x1b[7m"+fmt.Sprintf("%-10s %-24s %-6s %8s %10s", "POOL", "TUNNEL", "STATE", "STREAMS", "RTT")+"\x1b[0m",
+	)
+
+	for _, t := range tunnels {
+		state := "\x1b[32mup  \x1b[0m"
+		if !t.Alive {
+			state = "\x1b[31mdown\x1b[0m"
+		} else if t.Detached {
+			state = "\x1b[33mwait\x1b[0m"
+		}
+		lines = append(lines, fmt.Sprintf("%-10s %-24s %s   %8d %10s", t.Pool, t.Name, state, t.Streams, t.RTT.Round(time.Millisecond)))
+	}
+
+	lines = append(lines, "",
+		"\x1b[7m"+fmt.Sprintf("  %-22s %-24s %-30s %-11s %6s %10s  %-*s", "ID", "TUNNEL", "DESTINATION", "STATE", "AGE", "RATE", sparklineWidth, "THROUGHPUT")+"\x1b[0m",
+	)
+
+	// Leave room for the log at the bottom
+	room := height - len(lines) - dashboardLogLines - 2
+	first := 0
+	if d.selected >= room && room > 0 {
+		first = d.selected - room + 1
+	}
+
+	for i := first; i < len(clients) && i-first < room; i++ {
+		c := clients[i]
+		history := d.history[c.Id]
+
+		var rate uint64
+		if len(history) > 0 {
+			rate = history[len(history)-1]
+		}
+
+		marker := "  "
+		if i == d.selected {
+			marker = "\x1b[1m> "
+		}
+
+		lines = append(lines, fmt.Sprintf("%s%-22s %-24s %-30s %-11s %6s %10s  %s\x1b[0m",
+			marker, fit(c.Id, 22), fit(c.Tunnel, 24), fit(c.Destination, 30), c.State,
+			c.Age.Round(time.Second), formatBytes(rate)+"/s", sparkline(history)))
+	}
+
+	for len(lines) < height-dashboardLogLines-1 {
+		lines = append(lines, "")
+	}
+
+	lines = append(lines, "\x1b[2m"+strings.Repeat("─", width)+"\x1b[0m")
+	lines = append(lines, d.logs.last()...)
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		if i > 0 {
+			screen.WriteString("\r\n")
+		}
+		screen.WriteString(fit(line, width))
+		screen.WriteString("\x1b[K")
+	}
+	screen.WriteString("\x1b[J")
+
+	fmt.Print(screen.String())
+}
+
+func sparkline(history []uint64) string {
+	var max uint64
+	for _, v := range history {
+		if v > max {
+			max = v
+		}
+	}
+
+	var line []rune
+	for _, v := range history {
+		if max == 0 {
+			line = append(line, sparklineTicks[0])
+			continue
+		}
+		line = append(line, sparklineTicks[int(v*uint64(len(sparklineTicks)-1)/max)])
+	}
+
+	return string(line)
+}
+
+func formatBytes(n uint64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", n, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// fit truncates s to width visible characters, skipping escape sequences.
+func fit(s string, width int) string {
+	var out strings.Builder
+	visible := 0
+	escape := false
+
+	for _, r := range s {
+		switch {
+		case escape:
+			out.WriteRune(r)
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+				escape = false
+			}
+		case r == '\x1b':
+			escape = true
+			out.WriteRune(r)
+		case visible < width:
+			out.WriteRune(r)
+			visible++
+		}
+	}
+
+	return out.String()
+}
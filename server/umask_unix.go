@@ -0,0 +1,13 @@
+//go:build !windows
+
+package server
+
+import "syscall"
+
+// withUmask runs f with the file mode creation mask set to mask.
+func withUmask(mask int, f func()) {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+
+	f()
+}
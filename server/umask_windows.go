@@ -0,0 +1,7 @@
+//go:build windows
+
+package server
+
+func withUmask(mask int, f func()) {
+	f()
+}
@@ -0,0 +1,459 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	uploadGzip   = "gzip"
+	uploadCat    = "cat"
+	uploadBase64 = "base64"
+	uploadPrintf = "printf"
+	uploadSftp   = "sftp"
+	uploadScp    = "scp"
+)
+
+// Methods tried in order to copy the agent to the remote host
+var defaultUploadMethods = []string{uploadCat, uploadBase64, uploadPrintf, uploadSftp, uploadScp}
+
+// Remote directories for the agent, the first writable one allowing
+// execution is used. Their $VARIABLES are expanded by the remote shell.
+var defaultRemoteDirectories = []string{"$HOME", "/tmp", "/dev/shm", "$XDG_RUNTIME_DIR"}
+
+// uploadFunc copies size bytes of binary to remotePath and makes it
+// executable.
+type uploadFunc func(client *ssh.Client, binary io.Reader, size int64, remotePath string) error
+
+var uploaders = map[string]uploadFunc{
+	uploadGzip:   uploadWithGzip,
+	uploadCat:    uploadWithCat,
+	uploadBase64: uploadWithBase64,
+	uploadPrintf: uploadWithPrintf,
+	uploadSftp:   uploadWithSftp,
+	uploadScp:    uploadWithScp,
+}
+
+func (t *tunnel) getUploadMethods() []string {
+	methods := t.viper.GetStringSlice("Upload.Methods")
+	if len(methods) == 0 {
+		// Compressed first, the other methods still work without gzip
+		if t.viper.GetBool("Upload.Compress") {
+			return append([]string{uploadGzip}, defaultUploadMethods...)
+		}
+		return defaultUploadMethods
+	}
+
+	for _, method := range methods {
+		if _, prs := uploaders[method]; !prs {
+			logger.Fatalf("Unknown upload method %s, use %s or %s", method, strings.Join(defaultUploadMethods, ", "), uploadGzip)
+		}
+	}
+
+	return methods
+}
+
+func (t *tunnel) getRemoteDirectories() []string {
+	directories := t.viper.GetStringSlice("Upload.Directories")
+	if len(directories) == 0 {
+		return defaultRemoteDirectories
+	}
+	return directories
+}
+
+// readAgent returns the agent build for the remote host and its SHA-256.
+func (t *tunnel) readAgent() ([]byte, string, error) {
+	binary, err := t.agentBinary()
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(binary)
+
+	return binary, hex.EncodeToString(sum[:]), nil
+}
+
+// uploadForwarder copies the agent to the first usable remote directory with
+// the first upload method that works. With the cache enabled an identical
+// agent left by a previous connection is reused.
+func (t *tunnel) uploadForwarder(binary []byte, checksum string) error {
+	dir, err := t.findRemoteDirectory()
+	if err != nil {
+		logger.Warningf("No usable remote directory found (%s), trying the login one", err.Error())
+		dir = "."
+	}
+
+	t.keepAgent = false
+	t.daemonPath = dir + "/.daemon_" + utils.RandStringRunes(10)
+
+	userDir, err := t.prepareUserDirectory(dir)
+	if err != nil {
+		logger.Warningf("No private remote directory, the agent will not be cached nor recorded for cleanup: %s", err.Error())
+		userDir = ""
+	}
+
+	t.manifestPath = ""
+	if userDir != "" && t.getRemoteExecutable() == "" {
+		t.manifestPath = userDir + "/" + utils.RandStringRunes(10) + ".manifest"
+	}
+
+	t.prepareSession(userDir)
+
+	cachePath := ""
+	if userDir != "" && t.useAgentCache() {
+		cachePath = userDir + "/agent-" + checksum[:16]
+		if t.verifyRemote(cachePath, checksum) == nil {
+			logger.Infof("Using the cached agent %s", cachePath)
+			t.daemonPath = cachePath
+			t.keepAgent = true
+			return nil
+		}
+
+		// Uploaded aside, so agents running from the cache are not touched
+		t.daemonPath = userDir + "/.upload_" + utils.RandStringRunes(10)
+	}
+
+	var failures []string
+	for _, method := range t.getUploadMethods() {
+		err := uploaders[method](t.sshClient, bytes.NewReader(binary), int64(len(binary)), t.daemonPath)
+		if err == nil {
+			err = t.verifyRemote(t.daemonPath, checksum)
+		}
+		if err == errNoChecksumTool {
+			// Run once as uploaded, but never cached as it cannot be checked later
+			logger.Warningf("Unable to verify the agent uploaded with %s: %s", method, err.Error())
+			cachePath = ""
+			err = nil
+		}
+		if err == nil {
+			logger.Infof("Agent uploaded to %s with %s", t.daemonPath, method)
+			t.cacheUpload(cachePath)
+			return nil
+		}
+
+		logger.Warningf("Upload with %s failed: %s", method, err.Error())
+		failures = append(failures, method+": "+err.Error())
+	}
+
+	// Do not leave partial copies behind
+	runRemote(t.sshClient, nil, "rm -f "+shellQuote(t.daemonPath))
+
+	return errors.New("all upload methods failed (" + strings.Join(failures, "; ") + ")")
+}
+
+// cacheUpload moves the verified agent to its cache path. If that fails it
+// is run from where it was uploaded, and removed as usual.
+func (t *tunnel) cacheUpload(cachePath string) {
+	if cachePath == "" {
+		return
+	}
+
+	_, err := runRemote(t.sshClient, nil, "mv -f "+shellQuote(t.daemonPath)+" "+shellQuote(cachePath))
+	if err != nil {
+		logger.Warningf("Unable to cache the agent: %s", err.Error())
+		return
+	}
+
+	logger.Debug("Agent cached at", cachePath)
+	t.daemonPath = cachePath
+	t.keepAgent = true
+}
+
+// findRemoteDirectory returns the first remote directory where a file can be
+// written and executed, so read-only and noexec mounts are skipped.
+func (t *tunnel) findRemoteDirectory() (string, error) {
+	script := &strings.Builder{}
+	script.WriteString("for d in")
+	for _, dir := range t.getRemoteDirectories() {
+		script.WriteString(" " + shellQuoteVariables(dir))
+	}
+	script.WriteString(`; do
+[ -n "$d" ] && [ -d "$d" ] && [ -w "$d" ] || continue
+f="$d/.sasshimi_probe_$$"
+if printf '#!/bin/sh\nexit 0\n' > "$f" && chmod +x "$f" && "$f"; then rm -f "$f"; echo "$d"; exit 0; fi
+rm -f "$f"
+done
+exit 1`)
+
+	output, err := runRemote(t.sshClient, nil, script.String())
+	if err != nil {
+		return "", err
+	}
+
+	dir := strings.TrimSpace(string(output))
+	if dir == "" {
+		return "", errors.New("empty directory")
+	}
+
+	logger.Debug("Remote directory:", dir)
+
+	return dir, nil
+}
+
+// runRemote runs a command in a new session, returning its output. Errors
+// carry what the command wrote to stderr.
+func runRemote(client *ssh.Client, stdin io.Reader, command string) ([]byte, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, errors.New("Failed to create session: " + err.Error())
+	}
+	defer session.Close()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	if err := session.Run(command); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, errors.New(err.Error() + ": " + message)
+		}
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// shellQuote quotes s as a single word for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+var shellVariable = regexp.MustCompile(`\$(\w+|\{\w+\})`)
+
+// shellQuoteVariables quotes s as a single word for the remote shell, as
+// shellQuote, but leaving its $NAME and ${NAME} variables to be expanded.
+func shellQuoteVariables(s string) string {
+	quoted := &strings.Builder{}
+	last := 0
+
+	for _, match := range shellVariable.FindAllStringIndex(s, -1) {
+		if match[0] > last {
+			quoted.WriteString(shellQuote(s[last:match[0]]))
+		}
+		quoted.WriteString(`"` + s[match[0]:match[1]] + `"`)
+		last = match[1]
+	}
+
+	if last < len(s) || last == 0 {
+		quoted.WriteString(shellQuote(s[last:]))
+	}
+
+	return quoted.String()
+}
+
+func uploadWithCat(client *ssh.Client, binary io.Reader, size int64, remotePath string) error {
+	_, err := runRemote(client, binary, fmt.Sprintf("cat > %[1]s && chmod +x %[1]s", shellQuote(remotePath)))
+	return err
+}
+
+// uploadWithGzip sends the binary compressed, for slow links.
+func uploadWithGzip(client *ssh.Client, binary io.Reader, size int64, remotePath string) error {
+	reader, writer := io.Pipe()
+
+	go func() {
+		compressor, _ := gzip.NewWriterLevel(writer, gzip.BestCompression)
+		_, err := io.Copy(compressor, binary)
+		if err == nil {
+			err = compressor.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	_, err := runRemote(client, reader, fmt.Sprintf("gzip -dc > %[1]s && chmod +x %[1]s", shellQuote(remotePath)))
+	reader.Close()
+
+	return err
+}
+
+// uploadWithBase64 sends the binary encoded, for shells that mangle binary
+// input.
+func uploadWithBase64(client *ssh.Client, binary io.Reader, size int64, remotePath string) error {
+	reader, writer := io.Pipe()
+
+	go func() {
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWriter{writer: writer, width: 76})
+		_, err := io.Copy(encoder, binary)
+		if err == nil {
+			err = encoder.Close()
+		}
+		if err == nil {
+			_, err = writer.Write([]byte("\n"))
+		}
+		writer.CloseWithError(err)
+	}()
+
+	_, err := runRemote(client, reader, fmt.Sprintf("base64 -d > %[1]s && chmod +x %[1]s", shellQuote(remotePath)))
+	reader.Close()
+
+	return err
+}
+
+// uploadWithPrintf feeds the remote shell a script of printf commands, for
+// hosts with only shell builtins.
+func uploadWithPrintf(client *ssh.Client, binary io.Reader, size int64, remotePath string) error {
+	quoted := shellQuote(remotePath)
+	reader, writer := io.Pipe()
+
+	go func() {
+		script := bufio.NewWriter(writer)
+		fmt.Fprintf(script, "set -e\n: > %s\n", quoted)
+
+		chunk := make([]byte, 1024)
+		var err error
+		for {
+			var n int
+			n, err = io.ReadFull(binary, chunk)
+			if n > 0 {
+				script.WriteString("printf '")
+				for _, b := range chunk[:n] {
+					if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' {
+						script.WriteByte(b)
+					} else {
+						// Always three digits, so a following digit is not taken
+						fmt.Fprintf(script, `\%03o`, b)
+					}
+				}
+				if _, err = fmt.Fprintf(script, "' >> %s\n", quoted); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			fmt.Fprintf(script, "chmod +x %s\n", quoted)
+			err = script.Flush()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	_, err := runRemote(client, reader, "sh")
+	reader.Close()
+
+	return err
+}
+
+// uploadWithScp speaks the sink side of the scp protocol.
+func uploadWithScp(client *ssh.Client, binary io.Reader, size int64, remotePath string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return errors.New("Failed to create session: " + err.Error())
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &bytes.Buffer{}
+	session.Stderr = stderr
+
+	if err := session.Start("scp -t " + shellQuote(remotePath)); err != nil {
+		return err
+	}
+
+	replies := bufio.NewReader(stdout)
+
+	err = scpReply(replies)
+	if err == nil {
+		fmt.Fprintf(stdin, "C0755 %d %s\n", size, path.Base(remotePath))
+		err = scpReply(replies)
+	}
+	if err == nil {
+		if _, err = io.CopyN(stdin, binary, size); err == nil {
+			stdin.Write([]byte{0})
+			err = scpReply(replies)
+		}
+	}
+	stdin.Close()
+
+	if waitErr := session.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return errors.New(err.Error() + ": " + message)
+		}
+	}
+
+	return err
+}
+
+// scpReply reads the status byte of scp, followed by a message line on
+// errors.
+func scpReply(replies *bufio.Reader) error {
+	status, err := replies.ReadByte()
+	if err != nil {
+		return errors.New("scp closed: " + err.Error())
+	}
+	if status == 0 {
+		return nil
+	}
+
+	message, _ := replies.ReadString('\n')
+	return errors.New("scp: " + strings.TrimSpace(message))
+}
+
+// lineWriter breaks what it writes in lines of width bytes.
+type lineWriter struct {
+	writer io.Writer
+	width  int
+	column int
+}
+
+func (w *lineWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := w.width - w.column
+		if n > len(data) {
+			n = len(data)
+		}
+
+		if _, err := w.writer.Write(data[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		w.column += n
+		data = data[n:]
+
+		if w.column == w.width {
+			if _, err := w.writer.Write([]byte("\n")); err != nil {
+				return written, err
+			}
+			w.column = 0
+		}
+	}
+	return written, nil
+}
@@ -15,26 +15,328 @@
 package utils
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/op/go-logging"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
 )
 
 var Logger = logging.MustGetLogger("SaSSHimi")
 
+var colorFormat = logging.MustStringFormatter(
+	`%{color}%{time:15:04:05.000} %{program:10s} - %{module:-6s} %{shortfunc:-20s} ▶ %{level:-8s} %{id:03x}%{color:reset} %{message}`,
+)
+
+var plainFormat = logging.MustStringFormatter(
+	`%{time:2006-01-02 15:04:05.000} %{program} - %{module} %{shortfunc} ▶ %{level} %{message}`,
+)
+
+var backend logging.LeveledBackend
+
+// Levels set by module, the empty module being the default one
+var moduleLevels = map[string]logging.Level{"": logging.NOTICE}
+var moduleLevelsLock = &sync.Mutex{}
+
+// LogConfig selects the log output. Levels is a comma separated list of
+// level or module=level items, overriding the level given by Verbose.
+type LogConfig struct {
+	Format     string
+	File       string
+	MaxSize    int64
+	MaxBackups int
+	Verbose    int
+	Levels     string
+}
+
+// Fields are structured data attached to a log message.
+type Fields map[string]interface{}
+
+func (f Fields) String() string {
+	keys := make([]string, 0, len(f))
+	for key := range f {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		value := fmt.Sprint(f[key])
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		pairs[i] = key + "=" + value
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+// FieldLogger logs messages with a set of fields. Text outputs append them to
+// the message as key=value pairs and the JSON output adds them as keys.
+type FieldLogger struct {
+	logger *logging.Logger
+	fields Fields
+}
+
 func init() {
-	var format = logging.MustStringFormatter(
-		`%{color}%{time:15:04:05.000} %{program:10s} - %{shortfunc:-20s} ▶ %{level:-8s} %{id:03x}%{color:reset} %{message}`,
-	)
+	// Until SetupLogging is called, log to stderr
+	backend = logging.SetBackend(newLogBackend(os.Stderr, LogFormatText, true))
+	applyLevels()
+}
+
+func NewLogger(module string) *logging.Logger {
+	return logging.MustGetLogger(module)
+}
+
+func WithFields(logger *logging.Logger, fields Fields) *FieldLogger {
+	wrapped := *logger
+	wrapped.ExtraCalldepth++
+
+	return &FieldLogger{logger: &wrapped, fields: fields}
+}
+
+func (l *FieldLogger) Log(level logging.Level, message string) {
+	switch level {
+	case logging.CRITICAL:
+		l.logger.Critical(message, l.fields)
+	case logging.ERROR:
+		l.logger.Error(message, l.fields)
+	case logging.WARNING:
+		l.logger.Warning(message, l.fields)
+	case logging.NOTICE:
+		l.logger.Notice(message, l.fields)
+	case logging.INFO:
+		l.logger.Info(message, l.fields)
+	default:
+		l.logger.Debug(message, l.fields)
+	}
+}
+
+func (l *FieldLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Error(fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *FieldLogger) Warningf(format string, args ...interface{}) {
+	l.logger.Warning(fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *FieldLogger) Noticef(format string, args ...interface{}) {
+	l.logger.Notice(fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *FieldLogger) Infof(format string, args ...interface{}) {
+	l.logger.Info(fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *FieldLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debug(fmt.Sprintf(format, args...), l.fields)
+}
+
+// NewLogWriter returns a writer logging every line written to it at level,
+// for the libraries that take a standard log.Logger.
+func NewLogWriter(logger *FieldLogger, level logging.Level) io.Writer {
+	return &logWriter{logger: logger, level: level}
+}
+
+type logWriter struct {
+	logger *FieldLogger
+	level  logging.Level
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.Log(w.level, line)
+	}
+	return len(p), nil
+}
+
+// SetupLogging replaces the log outputs and levels. The log is always written
+// to stderr and, if File is set, also to a file rotated every MaxSize bytes.
+func SetupLogging(config LogConfig) error {
+	if config.Format == "" {
+		config.Format = LogFormatText
+	}
+	if config.Format != LogFormatText && config.Format != LogFormatJson {
+		return errors.New("unknown log format " + config.Format)
+	}
+
+	backends := []logging.Backend{newLogBackend(os.Stderr, config.Format, true)}
+
+	if config.File != "" {
+		file, err := OpenRotatingFile(config.File, config.MaxSize, config.MaxBackups)
+		if err != nil {
+			return errors.New("unable to open log file: " + err.Error())
+		}
+		backends = append(backends, newLogBackend(file, config.Format, false))
+	}
+
+	levels, err := parseLevels(config.Verbose, config.Levels)
+	if err != nil {
+		return err
+	}
+
+	moduleLevelsLock.Lock()
+	moduleLevels = levels
+	moduleLevelsLock.Unlock()
+
+	backend = logging.SetBackend(backends...)
+	applyLevels()
+
+	return nil
+}
+
+// SetLogLevel changes the level of a module, or of all of them if empty.
+func SetLogLevel(level logging.Level, module string) {
+	moduleLevelsLock.Lock()
+	if module == "" {
+		// Override the levels of every module too
+		for m := range moduleLevels {
+			moduleLevels[m] = level
+		}
+	}
+	moduleLevels[module] = level
+	moduleLevelsLock.Unlock()
+
+	applyLevels()
+}
+
+// GetLogLevel returns the level of a module, or the default one if empty.
+func GetLogLevel(module string) logging.Level {
+	moduleLevelsLock.Lock()
+	defer moduleLevelsLock.Unlock()
+
+	if level, prs := moduleLevels[module]; prs {
+		return level
+	}
+	return moduleLevels[""]
+}
+
+// LogEnv returns the environment variables, as NAME=value, that make another
+// SaSSHimi process log with the same levels, in JSON so its log can be
+// relayed. Older versions just ignore them.
+func LogEnv() []string {
+	moduleLevelsLock.Lock()
+	defer moduleLevelsLock.Unlock()
+
+	levels := []string{strings.ToLower(moduleLevels[""].String())}
+	for module, level := range moduleLevels {
+		if module != "" {
+			levels = append(levels, module+"="+strings.ToLower(level.String()))
+		}
+	}
+
+	return []string{"LOGFORMAT=" + LogFormatJson, "LOGLEVEL=" + strings.Join(levels, ",")}
+}
+
+// RedirectLog sends the log to w, without colors, until the returned function
+// is called.
+func RedirectLog(w io.Writer) func() {
+	previous := backend
+	logging.SetBackend(newLogBackend(w, LogFormatText, false))
+	applyLevels()
+
+	return func() {
+		backend = logging.SetBackend(previous)
+		applyLevels()
+	}
+}
+
+func parseLevels(verbose int, spec string) (map[string]logging.Level, error) {
+	levels := map[string]logging.Level{"": logging.NOTICE}
+	if verbose == 1 {
+		levels[""] = logging.INFO
+	} else if verbose > 1 {
+		levels[""] = logging.DEBUG
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		module, levelName := "", item
+		if idx := strings.Index(item, "="); idx >= 0 {
+			module, levelName = item[:idx], item[idx+1:]
+		}
+
+		level, err := logging.LogLevel(levelName)
+		if err != nil {
+			return nil, errors.New("invalid log level " + item)
+		}
+		levels[module] = level
+	}
+
+	return levels, nil
+}
+
+func applyLevels() {
+	moduleLevelsLock.Lock()
+	defer moduleLevelsLock.Unlock()
+
+	logging.SetLevel(moduleLevels[""], "")
+	for module, level := range moduleLevels {
+		if module != "" {
+			logging.SetLevel(level, module)
+		}
+	}
+}
+
+func newLogBackend(w io.Writer, format string, color bool) logging.Backend {
+	if format == LogFormatJson {
+		return &jsonBackend{writer: w, lock: &sync.Mutex{}}
+	}
+
+	formatter := plainFormat
+	if color {
+		formatter = colorFormat
+	}
+
+	return logging.NewBackendFormatter(logging.NewLogBackend(w, "", 0), formatter)
+}
+
+// jsonBackend writes every record as a JSON object in a line.
+type jsonBackend struct {
+	writer io.Writer
+	lock   *sync.Mutex
+}
 
-	logfile, _ := os.Open("/tmp/" + os.Args[0] + ".log")
+func (b *jsonBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	entry := make(map[string]interface{})
+	message := rec.Message()
 
-	stderrBackend := logging.NewLogBackend(os.Stderr, "", 0)
-	fileBackend := logging.NewLogBackend(logfile, "", 0)
+	if len(rec.Args) == 2 {
+		if fields, ok := rec.Args[1].(Fields); ok {
+			message = fmt.Sprint(rec.Args[0])
+			for key, value := range fields {
+				entry[key] = value
+			}
+		}
+	}
 
-	stderrBackendFormater := logging.NewBackendFormatter(stderrBackend, format)
+	entry["time"] = rec.Time.Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["module"] = rec.Module
+	entry["message"] = message
 
-	stderrBackendLeveled := logging.AddModuleLevel(stderrBackendFormater)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
 
-	logging.SetBackend(stderrBackendLeveled, fileBackend)
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
+	_, err = b.writer.Write(append(data, '\n'))
+	return err
 }